@@ -0,0 +1,370 @@
+/*
+Command wsbridge pipes WebSocket connections to a TCP service, so browsers can talk to it, or TCP connections to a WebSocket endpoint.
+The direction follows from the target: a host and port bridges WebSocket clients to it, a ws:// or wss:// URL tunnels TCP clients to it.
+
+	wsbridge -listen :8080 -target localhost:5432
+	wsbridge -listen :5432 -target wss://example.com/db
+
+Every WebSocket message is passed on as a stream of bytes, data from TCP is sent as binary messages.
+*/
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/fraog/ws"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//Bounds connecting to the target. Established connections are only closed by the idle timeout.
+	dialTimeout = 10 * time.Second
+
+	//The largest message WebSocket clients may send, since each is read whole before it is passed on
+	maxMessageSize = 16 << 20
+)
+
+//The reason connections are closed when nothing moved for the idle timeout
+var errIdle = errors.New("idle timeout")
+
+func main() {
+	listen := flag.String("listen", "", "address to listen on, such as :8080")
+	target := flag.String("target", "", "TCP address to connect WebSocket clients to, or ws:// or wss:// URL to tunnel TCP clients to")
+	idle := flag.Duration("idle", 5*time.Minute, "close connections when no data moved either way for this long, 0 for never")
+	max := flag.Int("max", 100, "maximum number of connections at once, 0 for no limit")
+	origins := flag.String("origins", "", "comma separated origins WebSocket clients may connect from, * for any, defaults to the same origin")
+	cert := flag.String("cert", "", "TLS certificate file, to accept wss:// clients")
+	key := flag.String("key", "", "TLS key file, to accept wss:// clients")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -listen addr -target host:port|ws://url [options]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *listen == "" || *target == "" || (*cert == "") != (*key == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	b := newBridge(*target, *idle, *max)
+	if *origins != "" {
+		var allowed []string
+		for _, origin := range strings.Split(*origins, ",") {
+			allowed = append(allowed, strings.TrimSpace(origin))
+		}
+		b.checkOrigin = ws.AllowOrigins(allowed...)
+	}
+
+	if strings.HasPrefix(*target, "ws://") || strings.HasPrefix(*target, "wss://") {
+		log.Fatal(b.serveTCP(*listen))
+	}
+	log.Fatal(b.serveWebSocket(*listen, *cert, *key))
+}
+
+/*
+Pipes the connections accepted on one side to the target.
+*/
+type bridge struct {
+	target      string
+	idle        time.Duration
+	checkOrigin func(*http.Request) bool
+	dialer      ws.Dialer
+
+	//Taken by each connection, nil for no limit
+	slots chan struct{}
+
+	//Numbers the connections in the log
+	count uint64
+
+	//The links of connected WebSocket clients
+	links   map[*ws.Conn]*link
+	linksMu sync.Mutex
+}
+
+/*
+Creates a bridge to target, allowing max connections at once, or any number if max is zero.
+*/
+func newBridge(target string, idle time.Duration, max int) *bridge {
+	b := &bridge{target: target, idle: idle, links: make(map[*ws.Conn]*link)}
+	if max > 0 {
+		b.slots = make(chan struct{}, max)
+	}
+	return b
+}
+
+/*
+Accepts WebSocket clients on addr and connects each to the TCP target, over TLS if a certificate is given.
+*/
+func (b *bridge) serveWebSocket(addr, cert, key string) error {
+	var s *ws.Server
+	var e error
+	if cert != "" {
+		var pair tls.Certificate
+		if pair, e = tls.LoadX509KeyPair(cert, key); e != nil {
+			return e
+		}
+		s, e = ws.ListenTLS(addr, &tls.Config{Certificates: []tls.Certificate{pair}})
+	} else {
+		s, e = ws.Listen(addr)
+	}
+	if e != nil {
+		return e
+	}
+
+	log.Printf("Bridging WebSocket clients on %s to %s\n", s.Addr(), b.target)
+	return b.serve(s)
+}
+
+/*
+Serves WebSocket clients accepted by s.
+The server bounds their handshakes, the idle timeout is the only one once they are connected.
+*/
+func (b *bridge) serve(s *ws.Server) error {
+	s.CheckOrigin = b.checkOrigin
+	s.MaxMessageSize = maxMessageSize
+	s.OnOpen = b.open
+	s.OnClose = b.close
+	return s.Serve(b.forward)
+}
+
+/*
+Connects a WebSocket client to the TCP target.
+Clients that can't be served are closed with CloseTryAgainLater or CloseBadGateway.
+*/
+func (b *bridge) open(c *ws.Conn) {
+	id := atomic.AddUint64(&b.count, 1)
+	remote := c.Base().RemoteAddr()
+	if !b.acquire() {
+		log.Printf("%d: %s refused, too many connections\n", id, remote)
+		c.CloseWithCode(ws.CloseTryAgainLater, "too many connections")
+		return
+	}
+
+	backend, e := net.DialTimeout("tcp", b.target, dialTimeout)
+	if e != nil {
+		log.Printf("%d: %s could not reach %s: %s\n", id, remote, b.target, e)
+		b.release()
+		c.CloseWithCode(ws.CloseBadGateway, "target unreachable")
+		return
+	}
+
+	l := b.link(id, remote, ws.NetConn(c, ws.BinaryMessage), backend)
+	b.linksMu.Lock()
+	b.links[c] = l
+	b.linksMu.Unlock()
+	go func() { l.end(l.receive()) }()
+}
+
+/*
+Passes a message from a WebSocket client on to the target.
+*/
+func (b *bridge) forward(c *ws.Conn, msg []byte) {
+	b.linksMu.Lock()
+	l := b.links[c]
+	b.linksMu.Unlock()
+	if l != nil {
+		l.active()
+		n, e := l.backend.Write(msg)
+		atomic.AddInt64(&l.sent, int64(n))
+		if e != nil {
+			l.end(e)
+		}
+	}
+}
+
+/*
+Closes the link of a WebSocket client that is gone, and frees its slot.
+*/
+func (b *bridge) close(c *ws.Conn) {
+	b.linksMu.Lock()
+	l := b.links[c]
+	delete(b.links, c)
+	b.linksMu.Unlock()
+	if l != nil {
+		l.end(nil)
+		l.finish()
+		b.release()
+	}
+}
+
+/*
+Accepts TCP clients on addr and tunnels each to the WebSocket target.
+*/
+func (b *bridge) serveTCP(addr string) error {
+	l, e := net.Listen("tcp", addr)
+	if e != nil {
+		return e
+	}
+
+	log.Printf("Tunneling TCP clients on %s to %s\n", l.Addr(), b.target)
+	for {
+		c, e := l.Accept()
+		if e != nil {
+			if errors.Is(e, net.ErrClosed) {
+				return e
+			}
+			log.Printf("Not accepted: %s\n", e)
+			continue
+		}
+		go b.toWebSocket(c)
+	}
+}
+
+/*
+Tunnels a TCP client to the WebSocket target.
+*/
+func (b *bridge) toWebSocket(c net.Conn) {
+	id := atomic.AddUint64(&b.count, 1)
+	remote := c.RemoteAddr()
+	if !b.acquire() {
+		log.Printf("%d: %s refused, too many connections\n", id, remote)
+		c.Close()
+		return
+	}
+	defer b.release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	backend, e := b.dialer.DialURL(ctx, b.target)
+	cancel()
+	if e != nil {
+		log.Printf("%d: %s could not reach %s: %s\n", id, remote, b.target, e)
+		c.Close()
+		return
+	}
+	b.pipe(id, remote, c, ws.NetConn(backend, ws.BinaryMessage))
+}
+
+/*
+Takes a connection slot, returning false if all are taken.
+*/
+func (b *bridge) acquire() bool {
+	if b.slots == nil {
+		return true
+	}
+	select {
+	case b.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *bridge) release() {
+	if b.slots != nil {
+		<-b.slots
+	}
+}
+
+/*
+Copies data both ways between a client and its connection to the target, until either side is done or it is idle.
+Returns the bytes sent to the target and received from it, and the error that ended the connection, if any.
+*/
+func (b *bridge) pipe(id uint64, remote net.Addr, client, backend net.Conn) (int64, int64, error) {
+	l := b.link(id, remote, client, backend)
+	go func() { l.end(l.receive()) }()
+	sent, e := io.Copy(backend, &activityReader{client, l.active})
+	atomic.AddInt64(&l.sent, sent)
+	l.end(e)
+	return l.finish()
+}
+
+/*
+A client connected to the target.
+Both are closed once either side is done or they are idle, since a WebSocket can't be closed in one direction only.
+*/
+type link struct {
+	id              uint64
+	remote          net.Addr
+	client, backend net.Conn
+	start           time.Time
+
+	//Any data moving either way keeps both directions open
+	active func()
+	timer  *time.Timer
+
+	//Closes both, recording the first cause
+	once  sync.Once
+	cause error
+
+	//Bytes moved each way, received is set once the target is done
+	sent     int64
+	received int64
+	done     chan struct{}
+}
+
+/*
+Links a client to its connection to the target.
+*/
+func (b *bridge) link(id uint64, remote net.Addr, client, backend net.Conn) *link {
+	log.Printf("%d: %s connected to %s\n", id, remote, b.target)
+	l := &link{id: id, remote: remote, client: client, backend: backend, start: time.Now(), done: make(chan struct{})}
+	l.active = func() {}
+	if b.idle > 0 {
+		l.timer = time.AfterFunc(b.idle, func() { l.end(errIdle) })
+		l.active = func() { l.timer.Reset(b.idle) }
+	}
+	return l
+}
+
+/*
+Copies what the target sends to the client, until either is done.
+*/
+func (l *link) receive() error {
+	defer close(l.done)
+	var e error
+	l.received, e = io.Copy(l.client, &activityReader{l.backend, l.active})
+	return e
+}
+
+func (l *link) end(e error) {
+	l.once.Do(func() {
+		l.cause = e
+		l.client.Close()
+		l.backend.Close()
+	})
+}
+
+/*
+Waits for the target to be done, and logs how the connection went.
+*/
+func (l *link) finish() (int64, int64, error) {
+	<-l.done
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	sent := atomic.LoadInt64(&l.sent)
+	status := "done"
+	if l.cause != nil {
+		status = l.cause.Error()
+	}
+	log.Printf("%d: %s closed after %s, %d bytes sent, %d bytes received: %s\n",
+		l.id, l.remote, time.Since(l.start).Round(time.Millisecond), sent, l.received, status)
+	return sent, l.received, l.cause
+}
+
+/*
+Reports each read that returned data.
+*/
+type activityReader struct {
+	r      io.Reader
+	active func()
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, e := r.r.Read(p)
+	if n > 0 {
+		r.active()
+	}
+	return n, e
+}
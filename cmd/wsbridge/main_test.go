@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"github.com/fraog/ws"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPipe(t *testing.T) {
+
+	//Data moves both ways until one side is done, then both are closed
+	client, clientEnd := net.Pipe()
+	backend, backendEnd := net.Pipe()
+	defer clientEnd.Close()
+	b := newBridge("backend", time.Second, 0)
+	type result struct {
+		sent, received int64
+		err            error
+	}
+	done := make(chan result, 1)
+	go func() {
+		sent, received, err := b.pipe(1, clientEnd.RemoteAddr(), clientEnd, backendEnd)
+		done <- result{sent, received, err}
+	}()
+
+	go client.Write([]byte("request"))
+	got := make([]byte, 7)
+	if _, err := io.ReadFull(backend, got); err != nil || string(got) != "request" {
+		t.Fatalf("Backend got %q: %v", got, err)
+	}
+	go backend.Write([]byte("reply"))
+	if _, err := io.ReadFull(client, got[:5]); err != nil || string(got[:5]) != "reply" {
+		t.Fatalf("Client got %q: %v", got[:5], err)
+	}
+	backend.Close()
+	if _, err := client.Read(got); err != io.EOF {
+		t.Errorf("Client was not closed with the backend: %v", err)
+	}
+	if r := <-done; r.sent != 7 || r.received != 5 || r.err != nil {
+		t.Errorf("Unexpected result %+v", r)
+	}
+
+	//Neither side sending anything closes both
+	client, clientEnd = net.Pipe()
+	backend, backendEnd = net.Pipe()
+	defer client.Close()
+	defer backend.Close()
+	b.idle = 20 * time.Millisecond
+	start := time.Now()
+	if _, _, err := b.pipe(2, clientEnd.RemoteAddr(), clientEnd, backendEnd); err != errIdle {
+		t.Errorf("Expected an idle timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Idle connection was closed after %s", elapsed)
+	}
+	if _, err := backend.Read(got); err != io.EOF {
+		t.Errorf("Backend was not closed: %v", err)
+	}
+}
+
+func TestSlots(t *testing.T) {
+
+	b := newBridge("backend", 0, 1)
+	if !b.acquire() || b.acquire() {
+		t.Fatalf("Expected one slot")
+	}
+	b.release()
+	if !b.acquire() {
+		t.Errorf("Slot was not released")
+	}
+
+	b = newBridge("backend", 0, 0)
+	for i := 0; i < 10; i++ {
+		if !b.acquire() {
+			t.Fatalf("Unlimited bridge refused connection %d", i)
+		}
+	}
+}
+
+func TestBridge(t *testing.T) {
+
+	//A TCP service echoing what it gets
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	//WebSocket clients reach it through the bridge, as many as allowed
+	b := newBridge(l.Addr().String(), time.Second, 1)
+	s, err := ws.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Listener.Close()
+	go b.serve(s)
+	addr := s.Addr().String()
+
+	//A client that never sends its handshake doesn't hold up the others
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	conn, err := ws.Dial(addr)
+	if err != nil {
+		t.Fatalf("Error dialing bridge: %s", err)
+	}
+	defer conn.Base().Close()
+	if err = conn.WriteMessage(ws.BinaryMessage, []byte("echo")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "echo" {
+		t.Errorf("Unexpected echo %q: %v", msg, err)
+	}
+	refused, err := ws.Dial(addr)
+	if err != nil {
+		t.Fatalf("Error dialing bridge: %s", err)
+	}
+	var ce *ws.CloseError
+	if _, _, err = refused.ReadMessage(); !errors.As(err, &ce) || ce.Code != ws.CloseTryAgainLater {
+		t.Errorf("Expected a connection over the limit to be refused, got %v", err)
+	}
+
+	//TCP clients reach it through a second bridge to the first, once the slot is free again
+	conn.Close()
+	for wait := time.Now().Add(time.Second); len(b.slots) > 0 && time.Now().Before(wait); {
+		time.Sleep(time.Millisecond)
+	}
+	tunnel := newBridge("ws://"+addr, time.Second, 0)
+	client, clientEnd := net.Pipe()
+	defer client.Close()
+	go tunnel.toWebSocket(clientEnd)
+	go client.Write([]byte("through both"))
+	got := make([]byte, 12)
+	if _, err = io.ReadFull(client, got); err != nil || string(got) != "through both" {
+		t.Errorf("Unexpected echo %q: %v", got, err)
+	}
+}
@@ -9,38 +9,33 @@ import (
 
 func main() {
 
-	//Create a websocket server on :7331
-	websockets, err := ws.Listen(":7331")
-	if err != nil {
-		log.Fatal(err)
-		return
-	}
+	//Create a websocket server and send every message to all clients
+	var websockets *ws.Server
+	websockets = ws.NewServer(func(conn *ws.Conn, msg []byte) {
+		_, err := websockets.Write(msg)
+		if err != nil {
+			log.Println(err)
+		}
+	})
 	defer websockets.Close()
 
 	//Broadcast a message when a client connects or disconnects.
 	websockets.OnOpen = func(conn *ws.Conn) {
 		_, err := websockets.WriteString(fmt.Sprintf("Client connected from %s", conn.Base().RemoteAddr()))
 		if err != nil {
-			log.Fatal(err)
+			log.Println(err)
 		}
 	}
 
 	websockets.OnClose = func(conn *ws.Conn) {
 		_, err := websockets.WriteString(fmt.Sprintf("Client disconnected from %s", conn.Base().RemoteAddr()))
 		if err != nil {
-			log.Fatal(err)
+			log.Println(err)
 		}
 	}
 
-	//Start serving as a Goroutine
-	go websockets.Serve(func(conn *ws.Conn, msg []byte) {
-		//Send the message to all clients
-		_, err := websockets.Write(msg)
-		if err != nil {
-			log.Fatal(err)
-		}
-	})
-
-	//Now, start a simple http file server
-	log.Fatal(http.ListenAndServe(":1337", http.FileServer(http.Dir("./client"))))
+	//Serve the websockets on /ws and the client files on the same port
+	http.Handle("/ws", websockets)
+	http.Handle("/", http.FileServer(http.Dir("./client")))
+	log.Fatal(http.ListenAndServe(":1337", nil))
 }
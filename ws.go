@@ -1,92 +1,273 @@
 package ws
 
-//FIXME: The server should validate origin?
-
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/tls"
 	"encoding/base64"
-	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
 const (
-	wsHash = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsHash       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	maxErrorBody = 1024
 )
 
+/*
+HandshakeError is returned when a server does not accept the opening handshake.
+It carries the rejected response, with at most the first 1KiB of its body.
+*/
+type HandshakeError struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Reason     string
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("Handshake failed (%d %s): %s", e.StatusCode, http.StatusText(e.StatusCode), e.Reason)
+}
+
+/*
+RequestError is returned by the server when it rejects an opening handshake.
+The client is sent a response with the status code, any extra header fields and the reason as its body.
+*/
+type RequestError struct {
+	StatusCode int
+	Header     http.Header
+	Reason     string
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("Request rejected (%d %s): %s", e.StatusCode, http.StatusText(e.StatusCode), e.Reason)
+}
+
+/*
+Creates the HTTP Response that tells the client why its request was rejected.
+*/
+func (e *RequestError) response() *http.Response {
+	response := new(http.Response)
+	response.ProtoMajor, response.ProtoMinor = 1, 1
+	response.StatusCode = e.StatusCode
+	response.Header = http.Header{
+		"Content-Type": []string{"text/plain; charset=utf-8"},
+		"Connection":   []string{"close"},
+	}
+	for k, v := range e.Header {
+		response.Header[k] = v
+	}
+	body := e.Reason + "\n"
+	response.ContentLength = int64(len(body))
+	response.Body = io.NopCloser(strings.NewReader(body))
+	return response
+}
+
+/*
+UnsupportedSchemeError is returned when dialing a URL whose scheme is not a WebSocket scheme.
+*/
+type UnsupportedSchemeError struct {
+	Scheme string
+}
+
+func (e *UnsupportedSchemeError) Error() string {
+	return fmt.Sprintf("Unsupported URL scheme: %q", e.Scheme)
+}
+
+/*
+A Dialer contains options for dialing WebSocket connections.
+The zero value dials with default options.
+*/
+type Dialer struct {
+	//TLSConfig configures wss:// connections, for custom roots or client certificates.
+	//If its ServerName is empty, the host of the dialed URL is used.
+	TLSConfig *tls.Config
+
+	//Subprotocols are offered to the server in order of preference.
+	Subprotocols []string
+
+	//PingInterval, if set, pings the server on this interval to keep the connection alive.
+	//The connection is closed if the server does not answer within PongTimeout, or within PingInterval if it is zero.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	//CloseTimeout is how long closing the connection waits for the server to answer the close frame. Defaults to 5 seconds.
+	CloseTimeout time.Duration
+
+	//Compression, if set, offers to compress messages with permessage-deflate.
+	Compression *Compression
+
+	//Extensions are offered to the server, after compression.
+	Extensions []Extension
+}
+
 /*
 Dial dials a connection to a webserver at the specified host.
 Returns the connection or an error if no connection was made.
 */
 func Dial(host string) (*Conn, error) {
-	c, e := net.Dial("tcp", host)
+	return DialURL(context.Background(), "ws://"+host+"/ws")
+}
+
+/*
+DialProtocol dials a connection to a webserver with protocols specified.
+The protocols are given as a comma separated list in order of preference.
+Returns the connection or an error if no connection was made.
+*/
+func DialProtocol(host string, proto string) (*Conn, error) {
+	d := Dialer{Subprotocols: splitTokens(proto)}
+	return d.DialURL(context.Background(), "ws://"+host+"/ws")
+}
+
+/*
+DialURL dials a connection to the WebSocket endpoint at rawurl, for example "ws://example.com:8080/chat?room=1", using default options.
+Returns the connection or an error if no connection was made.
+*/
+func DialURL(ctx context.Context, rawurl string) (*Conn, error) {
+	var d Dialer
+	return d.DialURL(ctx, rawurl)
+}
+
+/*
+DialURL dials a connection to the WebSocket endpoint at rawurl. Both ws:// and wss:// URLs are supported.
+The context bounds connecting, the TLS handshake and the opening handshake.
+Returns the connection or an error if no connection was made.
+*/
+func (d *Dialer) DialURL(ctx context.Context, rawurl string) (*Conn, error) {
+	u, e := url.Parse(rawurl)
 	if e != nil {
 		return nil, e
 	}
+	return d.dial(ctx, u)
+}
+
+/*
+Dials the endpoint at u and performs the opening handshake.
+*/
+func (d *Dialer) dial(ctx context.Context, u *url.URL) (*Conn, error) {
+	var port string
+	switch u.Scheme {
+	case "ws":
+		port = "80"
+	case "wss":
+		port = "443"
+	default:
+		return nil, &UnsupportedSchemeError{u.Scheme}
+	}
 
-	//Send an http websocket request
-	req := createRequest("/ws")
-	e = req.Write(c)
-	if e != nil {
-		return nil, e
+	//Use the default port if the URL has none
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), port)
 	}
 
-	//Read Response
-	res, e := http.ReadResponse(bufio.NewReader(c), nil)
+	var nd net.Dialer
+	c, e := nd.DialContext(ctx, "tcp", addr)
 	if e != nil {
 		return nil, e
 	}
 
-	if res == nil {
-		return nil, errors.New("Did not get accept response from server.")
+	if u.Scheme == "wss" {
+		var config *tls.Config
+		if d.TLSConfig != nil {
+			config = d.TLSConfig.Clone()
+		} else {
+			config = new(tls.Config)
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		tc := tls.Client(c, config)
+		if e = tc.HandshakeContext(ctx); e != nil {
+			c.Close()
+			return nil, e
+		}
+		c = tc
 	}
 
-	//TODO: Verify accept key?
-	//fmt.Printf("AcceptKey: %s\n", res.Header.Get("Sec-WebSocket-Accept"))
-
-	return &Conn{c, true, 0, nil, nil, nil}, nil
+	conn, e := d.handshake(ctx, c, u)
+	if e != nil {
+		c.Close()
+		return nil, e
+	}
+	conn.closeTimeout = d.CloseTimeout
+	if d.PingInterval > 0 {
+		go conn.keepalive(d.PingInterval, d.PongTimeout)
+	}
+	return conn, nil
 }
 
 /*
-DialProtocol dials a connection to a webserver with protocols specified.
-Returns the connection or an error if no connection was made.
+Sends the websocket request for u over c and reads the response.
+The handshake is aborted if ctx is done before it completes.
 */
-func DialProtocol(host string, proto string) (*Conn, error) {
-	c, e := net.Dial("tcp", host)
-	if e != nil {
-		return nil, e
+func (d *Dialer) handshake(ctx context.Context, c net.Conn, u *url.URL) (*Conn, error) {
+	if d, ok := ctx.Deadline(); ok {
+		c.SetDeadline(d)
 	}
+	stop := context.AfterFunc(ctx, func() {
+		//Unblock any pending read or write
+		c.SetDeadline(aLongTimeAgo)
+	})
+	defer stop()
 
 	//Send an http websocket request
-	req := createRequest("/ws")
-	e = req.Write(c)
+	req, e := createRequest(u)
 	if e != nil {
 		return nil, e
 	}
+	if len(d.Subprotocols) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(d.Subprotocols, ", "))
+	}
+	if d.Compression != nil || len(d.Extensions) > 0 {
+		req.Header.Set("Sec-WebSocket-Extensions", offerExtensions(d.Compression, d.Extensions))
+	}
+	e = req.Write(c)
+	if e != nil {
+		return nil, contextError(ctx, e)
+	}
 
-	//Add protocol to header
-	req.Header.Add("Sec-WebSocket-Protocol", proto)
-
-	//Read response
-	reader := bufio.NewReader(c)
-	res, e := http.ReadResponse(reader, nil)
+	//Read Response, keeping the reader since frames may follow it
+	br := bufio.NewReader(c)
+	res, e := http.ReadResponse(br, req)
 	if e != nil {
-		return nil, e
+		return nil, contextError(ctx, e)
 	}
 
-	if res == nil {
-		return nil, errors.New("Did not get accept response from server.")
+	if e = checkResponse(res, req.Header.Get("Sec-WebSocket-Key"), d.Subprotocols); e != nil {
+		return nil, e
+	}
+	extensions, reason := confirmExtensions(res.Header, d.Compression, d.Extensions)
+	if reason != "" {
+		return nil, &HandshakeError{res.StatusCode, res.Header, nil, reason}
 	}
 
-	//TODO: Verify accept key?
-	//fmt.Printf("AcceptKey: %s\n", res.Header.Get("Sec-WebSocket-Accept"))
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	c.SetDeadline(time.Time{})
 
-	//TODO: Verify protocol?
-	//fmt.Printf("AcceptProto: %s\n", res.Header.Get("Sec-WebSocket-Protocol"))
+	conn := newConn(c, br, true)
+	conn.subprotocol = res.Header.Get("Sec-WebSocket-Protocol")
+	extensions.apply(conn, d.Compression, true)
+	return conn, nil
+}
 
-	return &Conn{c, true, 0, nil, nil, nil}, nil
+/*
+Returns the context's error in place of e if the context is done.
+*/
+func contextError(ctx context.Context, e error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return e
 }
 
 /*
@@ -99,7 +280,21 @@ func Listen(host string) (*Server, error) {
 	if s, e = net.Listen("tcp", host); e != nil {
 		return nil, e
 	}
-	return &Server{s, make(map[int64]*Conn), nil, nil, nil, nil, nil}, nil
+	return newServer(s), nil
+}
+
+/*
+ListenTLS creates a new server, listening on host and terminating TLS with config.
+The config must contain at least one certificate or set GetCertificate.
+Returns nil and error if an error was encountered.
+*/
+func ListenTLS(host string, config *tls.Config) (*Server, error) {
+	var s net.Listener
+	var e error
+	if s, e = tls.Listen("tcp", host, config); e != nil {
+		return nil, e
+	}
+	return newServer(s), nil
 }
 
 /*
@@ -115,27 +310,156 @@ func ListenAndServe(host string, handler func(*Conn, []byte)) error {
 	return s.Serve(handler)
 }
 
+/*
+ListenAndServeTLS creates a new server, listening on host with the certificate and key found in the given files, and serves with handler function.
+Returns an error if encountered.
+*/
+func ListenAndServeTLS(host, certFile, keyFile string, handler func(*Conn, []byte)) error {
+	cert, e := tls.LoadX509KeyPair(certFile, keyFile)
+	if e != nil {
+		return e
+	}
+	var s *Server
+	if s, e = ListenTLS(host, &tls.Config{Certificates: []tls.Certificate{cert}}); e != nil {
+		return e
+	}
+	return s.Serve(handler)
+}
+
+/*
+Checks that res accepts the websocket request that was sent with key, offering protocols.
+Returns a HandshakeError describing the response if it does not.
+*/
+func checkResponse(res *http.Response, key string, protocols []string) error {
+	var reason string
+	switch {
+	case res.StatusCode != http.StatusSwitchingProtocols:
+		reason = "unexpected status"
+	case !headerContainsToken(res.Header, "Upgrade", "websocket"):
+		reason = "missing Upgrade: websocket"
+	case !headerContainsToken(res.Header, "Connection", "upgrade"):
+		reason = "missing Connection: Upgrade"
+	case res.Header.Get("Sec-WebSocket-Accept") != createAcceptHash(key):
+		reason = "mismatched Sec-WebSocket-Accept"
+	case !validSubprotocol(res.Header, protocols):
+		reason = "server chose a subprotocol that was not offered"
+	default:
+		return nil
+	}
+
+	//Keep the start of the body, it usually explains the rejection
+	body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+	res.Body.Close()
+	return &HandshakeError{res.StatusCode, res.Header, body, reason}
+}
+
+/*
+Returns true if the comma separated header field name contains token, ignoring case.
+*/
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range splitTokens(v) {
+			if strings.EqualFold(t, token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+Returns true if the Sec-WebSocket-Protocol in h is empty or one of the offered protocols.
+*/
+func validSubprotocol(h http.Header, offered []string) bool {
+	values := h.Values("Sec-WebSocket-Protocol")
+	if len(values) == 0 {
+		return true
+	}
+	if len(values) > 1 {
+		return false
+	}
+	for _, p := range offered {
+		if p == values[0] {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Splits a comma separated header value into its trimmed, non-empty tokens.
+*/
+func splitTokens(v string) []string {
+	var tokens []string
+	for _, t := range strings.Split(v, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
 /*
 Creates a websocket key for a websocket request
 */
-func createRequestHash() string {
-	b := make([]byte, 8)
-	rand.Read(b)
-	//TODO: ERROR
-	return base64.StdEncoding.EncodeToString(b)
+func createRequestHash() (string, error) {
+	b := make([]byte, 16)
+	if _, e := rand.Read(b); e != nil {
+		return "", e
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
 }
 
 /*
-Creates an http.Request to send to a websocket server.
+Creates an http.Request to send to the websocket server at u.
 */
-func createRequest(host string) *http.Request { //, protocols string) {
-	req, _ := http.NewRequest("GET", host, nil)
-	//TODO: Error handle
+func createRequest(u *url.URL) (*http.Request, error) {
+	key, e := createRequestHash()
+	if e != nil {
+		return nil, e
+	}
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
 	req.Header.Add("Upgrade", "websocket")
 	req.Header.Add("Connection", "Upgrade")
-	req.Header.Add("Sec-WebSocket-Key", createRequestHash())
+	req.Header.Add("Sec-WebSocket-Key", key)
 	req.Header.Add("Sec-WebSocket-Version", "13")
-	return req
+	return req, nil
+}
+
+/*
+Checks that req is a valid websocket opening handshake as described by RFC 6455, section 4.2.1.
+Returns a RequestError describing the response to send if it is not.
+*/
+func checkRequest(req *http.Request) *RequestError {
+	switch {
+	case req.Method != "GET":
+		return &RequestError{http.StatusMethodNotAllowed, http.Header{"Allow": []string{"GET"}}, "websocket requests must use GET"}
+	case !req.ProtoAtLeast(1, 1):
+		return &RequestError{http.StatusHTTPVersionNotSupported, nil, "websocket requests must use HTTP/1.1 or later"}
+	case req.Host == "":
+		return &RequestError{http.StatusBadRequest, nil, "missing Host"}
+	case !headerContainsToken(req.Header, "Upgrade", "websocket"):
+		return &RequestError{http.StatusBadRequest, nil, "missing Upgrade: websocket"}
+	case !headerContainsToken(req.Header, "Connection", "upgrade"):
+		return &RequestError{http.StatusBadRequest, nil, "missing Connection: Upgrade"}
+	case req.Header.Get("Sec-WebSocket-Version") != "13":
+		return &RequestError{http.StatusUpgradeRequired, http.Header{"Sec-WebSocket-Version": []string{"13"}}, "unsupported Sec-WebSocket-Version"}
+	}
+
+	//The key must be a base64 encoded 16 byte nonce
+	key, e := base64.StdEncoding.DecodeString(req.Header.Get("Sec-WebSocket-Key"))
+	if e != nil || len(key) != 16 {
+		return &RequestError{http.StatusBadRequest, nil, "invalid Sec-WebSocket-Key"}
+	}
+	return nil
 }
 
 /*
@@ -143,25 +467,27 @@ Creates the hash to send back to a client if the request is accepted.
 */
 func createAcceptHash(key string) string {
 	sha1 := sha1.New()
-	sha1.Write([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	sha1.Write([]byte(key + wsHash))
 	return base64.StdEncoding.EncodeToString(sha1.Sum(nil))
 }
 
 /*
-Creates the HTTP Response to send back to the client if the request is accepted.
+Creates the HTTP Response to send back to the client if the request is accepted, with the chosen subprotocol and extensions if any.
 */
-func createAcceptResponse(req *http.Request) *http.Response {
+func createAcceptResponse(req *http.Request, protocol string, extensions []string) *http.Response {
 	response := new(http.Response)
+	response.ProtoMajor, response.ProtoMinor = 1, 1
 	response.StatusCode = http.StatusSwitchingProtocols
 	response.Header = http.Header{
 		"Upgrade":              []string{"websocket"},
 		"Connection":           []string{"Upgrade"},
 		"Sec-WebSocket-Accept": []string{createAcceptHash(req.Header.Get("Sec-WebSocket-Key"))},
 	}
-	//FIXME: For now just accept any protocols
-	ptcl := req.Header.Get("Sec-WebSocket-Protocol")
-	if len(ptcl) > 0 {
-		response.Header.Add("Sec-WebSocket-Protocol", req.Header.Get("Sec-WebSocket-Protocol"))
+	if protocol != "" {
+		response.Header.Add("Sec-WebSocket-Protocol", protocol)
+	}
+	if len(extensions) > 0 {
+		response.Header.Add("Sec-WebSocket-Extensions", strings.Join(extensions, ", "))
 	}
 	return response
 }
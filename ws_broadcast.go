@@ -0,0 +1,63 @@
+package ws
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+BroadcastError is returned when a message could not be written to some of the clients it was sent to.
+Errors holds the error for each of those clients, by connection id.
+*/
+type BroadcastError struct {
+	Errors map[string]error
+}
+
+func (e *BroadcastError) Error() string {
+	ids := make([]string, 0, len(e.Errors))
+	for id := range e.Errors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	failed := make([]string, len(ids))
+	for i, id := range ids {
+		failed[i] = fmt.Sprintf("%s: %s", id, e.Errors[id])
+	}
+	return fmt.Sprintf("Broadcast failed for %d connections: %s", len(ids), strings.Join(failed, "; "))
+}
+
+/*
+Writes message to each of clients concurrently and waits for all of them.
+Returns the fewest bytes written to any client, and a BroadcastError if any of them failed.
+*/
+func broadcast(clients []*Conn, message []byte) (int, error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	written := len(message)
+	errs := make(map[string]error)
+
+	for _, client := range clients {
+		wg.Add(1)
+		go func(c *Conn) {
+			defer wg.Done()
+			n, e := c.Write(message)
+			if e != nil {
+				mu.Lock()
+				errs[c.Id()] = e
+				if n < written {
+					written = n
+				}
+				mu.Unlock()
+			}
+		}(client)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return written, &BroadcastError{errs}
+	}
+	return written, nil
+}
@@ -0,0 +1,251 @@
+package ws
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+Close status codes, as defined by RFC 6455, section 7.4.1.
+*/
+const (
+	CloseNormal             = 1000
+	CloseGoingAway          = 1001
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatus           = 1005
+	CloseAbnormal           = 1006
+	CloseInvalidPayload     = 1007
+	ClosePolicyViolation    = 1008
+	CloseMessageTooBig      = 1009
+	CloseMandatoryExtension = 1010
+	CloseInternalError      = 1011
+	CloseServiceRestart     = 1012
+	CloseTryAgainLater      = 1013
+	CloseBadGateway         = 1014
+)
+
+const (
+	defaultCloseTimeout = 5 * time.Second
+	maxCloseReason      = maxControlPayload - 2
+)
+
+//Returned when a close frame could not be written within the close timeout
+var errCloseTimeout = errors.New("Close frame could not be sent in time.")
+
+/*
+CloseError describes how a connection was closed.
+Code is the status code sent by the other end, or CloseAbnormal if the connection was lost without a close frame.
+*/
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("Connection closed (%d).", e.Code)
+	}
+	return fmt.Sprintf("Connection closed (%d): %s", e.Code, e.Reason)
+}
+
+/*
+Returns true if code may be sent in a close frame.
+*/
+func validCloseCode(code int) bool {
+	switch {
+	case code >= CloseNormal && code <= CloseUnsupportedData:
+		return true
+	case code >= CloseInvalidPayload && code <= CloseBadGateway:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+/*
+Sets how long Close waits for the other end to answer the close frame before closing the underlying connection.
+*/
+func (c *Conn) SetCloseTimeout(d time.Duration) {
+	c.closeTimeout = d
+}
+
+/*
+CloseWithCode starts the close handshake, sending a close frame with the status code and reason.
+It waits for the other end to answer with its own close frame, at most for the close timeout, then closes the underlying connection.
+If no other goroutine is reading the connection, the answer is read here and anything arriving before it is discarded.
+*/
+func (c *Conn) CloseWithCode(code int, reason string) error {
+	if !validCloseCode(code) {
+		return fmt.Errorf("Invalid close code %d.", code)
+	}
+	if len(reason) > maxCloseReason {
+		return errors.New("Close reason is longer than 123 bytes.")
+	}
+
+	//Sending the close frame and waiting for the answer share the timeout
+	deadline := time.Now().Add(c.closeWait())
+	if e := c.sendClose(code, reason, deadline); e != nil {
+		return c.teardown()
+	}
+
+	//Read the answer here, unless a reader is busy and will see it
+	if c.readMu.TryLock() {
+		defer c.readMu.Unlock()
+		c.readUntilClose(deadline)
+		return c.teardown()
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-c.closeReceived:
+	case <-c.done:
+	case <-timer.C:
+	}
+	return c.teardown()
+}
+
+/*
+Returns how long closing waits for the other end.
+*/
+func (c *Conn) closeWait() time.Duration {
+	if c.closeTimeout <= 0 {
+		return defaultCloseTimeout
+	}
+	return c.closeTimeout
+}
+
+/*
+Reads and discards messages until the close frame arrives, at most until deadline. Called with readMu held.
+*/
+func (c *Conn) readUntilClose(deadline time.Time) {
+	if c.readBroken {
+		return
+	}
+	c.deadlineMu.Lock()
+	c.nc.SetReadDeadline(deadline)
+	c.deadlineMu.Unlock()
+
+	//The rest of a message being read comes first
+	if c.reader != nil {
+		if _, e := io.Copy(io.Discard, readFunc(c.reader.read)); e != nil {
+			return
+		}
+	}
+
+	//The close frame is handled by nextFrame, which returns its status
+	for {
+		var f DataFrame
+		if e := c.nextFrame(&f); e != nil {
+			return
+		}
+		if _, e := io.CopyN(io.Discard, c.br, int64(f.length)); e != nil {
+			return
+		}
+	}
+}
+
+/*
+Sends a close frame with code and reason, unless one was already sent.
+A code of CloseNoStatus sends a close frame without a body.
+The frame waits behind other writes, which may be stuck, so it is given until deadline. If it can't be sent by then the connection is closed.
+*/
+func (c *Conn) sendClose(code int, reason string, deadline time.Time) error {
+	var payload []byte
+	if code != CloseNoStatus {
+		payload = make([]byte, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		copy(payload[2:], reason)
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		written <- c.writeFrameBy(deadline, msbOn, opClose, payload)
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	var e error
+	select {
+	case e = <-written:
+	case <-timer.C:
+		e = errCloseTimeout
+	}
+	if e == ErrCloseSent {
+		return nil
+	}
+	if e != nil {
+		c.teardown()
+	}
+	return e
+}
+
+/*
+Handles a close frame from the other end: the status is parsed, the close frame is echoed and the connection is closed.
+Returns the CloseError describing the status sent by the other end.
+*/
+func (c *Conn) receiveClose(payload []byte) error {
+	ce := &CloseError{Code: CloseNoStatus}
+	if len(payload) == 1 {
+		return c.fail(CloseProtocolError, "invalid close frame")
+	}
+	if len(payload) >= 2 {
+		ce.Code = int(binary.BigEndian.Uint16(payload))
+		ce.Reason = string(payload[2:])
+		if !validCloseCode(ce.Code) {
+			return c.fail(CloseProtocolError, "invalid close code")
+		}
+		if !utf8.Valid(payload[2:]) {
+			return c.fail(CloseInvalidPayload, "invalid UTF-8 in close reason")
+		}
+	}
+
+	c.closeOnce.Do(func() {
+		c.closeStatus = ce
+		close(c.closeReceived)
+	})
+	c.sendClose(ce.Code, "", time.Now().Add(c.closeWait()))
+	c.teardown()
+	return ce
+}
+
+/*
+Fails the connection: a close frame with code and reason is sent, and the connection is closed without waiting for an answer.
+Returns the CloseError describing the failure.
+*/
+func (c *Conn) fail(code int, reason string) error {
+	c.sendClose(code, reason, time.Now().Add(c.closeWait()))
+	c.teardown()
+	return &CloseError{code, reason}
+}
+
+/*
+Closes the underlying connection and removes it from its server, once, then calls OnClose.
+*/
+func (c *Conn) teardown() error {
+	var e error
+	closed := false
+	c.teardownOnce.Do(func() {
+		close(c.done)
+		e = c.nc.Close()
+		closed = true
+
+		//If its a server connection, remove from clients
+		if c.server != nil {
+			c.server.remove(c)
+		}
+	})
+
+	//Close callback, on its own goroutine since the caller may hold the connection's locks
+	if closed && c.OnClose != nil {
+		go c.OnClose(c)
+	}
+	return e
+}
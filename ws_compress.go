@@ -0,0 +1,444 @@
+package ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	//Go's flate always uses the largest window, 2^15 bytes
+	maxWindowBits = 15
+	minWindowBits = 8
+	maxWindow     = 1 << maxWindowBits
+
+	//A compressed message ends with an empty sync flush block, which is left off on the wire
+	deflateSync = "\x00\x00\xff\xff"
+
+	//Appended when decompressing: the sync flush block, then an empty final block so the reader ends cleanly
+	deflateTail = deflateSync + "\x01\x00\x00\xff\xff"
+)
+
+//Returned by the decompressor when the compressed data is invalid
+var errInvalidCompressed = errors.New("Invalid compressed data.")
+
+//Returned when a decompressed message is over the read limit
+var errMessageTooBig = errors.New("Message is over the read limit.")
+
+/*
+Compression configures the permessage-deflate extension (RFC 7692), which compresses messages.
+Set it on a Dialer to offer compression to servers, or on an Upgrader or Server to accept it from clients.
+*/
+type Compression struct {
+	//Level is the flate compression level, from flate.HuffmanOnly to flate.BestCompression.
+	//Zero, or an invalid level, uses flate.DefaultCompression.
+	Level int
+
+	//Threshold is the size in bytes below which messages are sent uncompressed.
+	Threshold int
+
+	//ServerNoContextTakeover and ClientNoContextTakeover ask for the server's or the client's compression to start over with each message.
+	//This saves the memory of a compressor kept for each connection, at the cost of compressing worse.
+	ServerNoContextTakeover bool
+	ClientNoContextTakeover bool
+
+	//ServerMaxWindowBits and ClientMaxWindowBits ask for the server's or the client's compression to use a window of 2^n bytes, n from 8 to 15,
+	//which saves memory on both ends. Zero, or a value outside that range, leaves the window at its maximum of 15 bits.
+	//Compression here always uses the maximum window, so a Dialer only asks the server with ServerMaxWindowBits, and an Upgrader or Server the client with ClientMaxWindowBits.
+	//A client limited by the server anyway sends its messages uncompressed, a server declines offers limiting its window.
+	ServerMaxWindowBits int
+	ClientMaxWindowBits int
+}
+
+/*
+Returns a configured window size, or zero if it is left at the maximum.
+*/
+func windowBits(bits int) int {
+	if bits < minWindowBits || bits >= maxWindowBits {
+		return 0
+	}
+	return bits
+}
+
+/*
+The parameters of a permessage-deflate offer or response.
+A window size of zero means the parameter is absent.
+*/
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	serverMaxWindowBits     int
+	clientMaxWindowBits     int
+}
+
+/*
+Returns the Sec-WebSocket-Extensions value for these parameters.
+*/
+func (p *deflateParams) String() string {
+	s := "permessage-deflate"
+	if p.serverNoContextTakeover {
+		s += "; server_no_context_takeover"
+	}
+	if p.clientNoContextTakeover {
+		s += "; client_no_context_takeover"
+	}
+	if p.serverMaxWindowBits != 0 {
+		s += "; server_max_window_bits=" + strconv.Itoa(p.serverMaxWindowBits)
+	}
+	if p.clientMaxWindowBits != 0 {
+		s += "; client_max_window_bits=" + strconv.Itoa(p.clientMaxWindowBits)
+	}
+	return s
+}
+
+/*
+Returns the offer a client sends with this configuration.
+It says the server may limit the client's window, which is honored by not compressing.
+*/
+func (cfg *Compression) offer() string {
+	p := deflateParams{
+		serverNoContextTakeover: cfg.ServerNoContextTakeover,
+		clientNoContextTakeover: cfg.ClientNoContextTakeover,
+		serverMaxWindowBits:     windowBits(cfg.ServerMaxWindowBits),
+	}
+	return p.String() + "; client_max_window_bits"
+}
+
+/*
+Checks a permessage-deflate offer from a client.
+Returns the parameters to reply with, or nil if the server can't honor it.
+*/
+func (cfg *Compression) accept(params []ExtensionParam) *deflateParams {
+	p, ok := parseDeflateParams(params)
+	if !ok {
+		return nil
+	}
+
+	//Our compressor can't use a smaller window than the maximum
+	if p.serverMaxWindowBits != 0 && p.serverMaxWindowBits < maxWindowBits {
+		return nil
+	}
+
+	res := &deflateParams{
+		serverNoContextTakeover: p.serverNoContextTakeover || cfg.ServerNoContextTakeover,
+		clientNoContextTakeover: p.clientNoContextTakeover || cfg.ClientNoContextTakeover,
+	}
+	if p.serverMaxWindowBits != 0 {
+		res.serverMaxWindowBits = maxWindowBits
+	}
+
+	//The client's window can only be limited if it said it supports that
+	if bits := windowBits(cfg.ClientMaxWindowBits); bits != 0 && bits < p.clientMaxWindowBits {
+		res.clientMaxWindowBits = bits
+	}
+	return res
+}
+
+/*
+Checks the permessage-deflate parameters a server responded with, against the offer made with this configuration.
+Returns the accepted parameters, or the reason the response is invalid.
+*/
+func (cfg *Compression) confirm(params []ExtensionParam) (*deflateParams, string) {
+	p, ok := parseDeflateParams(params)
+	switch {
+	case !ok:
+		return nil, "invalid permessage-deflate parameters"
+	case cfg.ServerNoContextTakeover && !p.serverNoContextTakeover:
+		return nil, "server did not accept server_no_context_takeover"
+	}
+	if bits := windowBits(cfg.ServerMaxWindowBits); bits != 0 && (p.serverMaxWindowBits == 0 || p.serverMaxWindowBits > bits) {
+		return nil, "server did not accept server_max_window_bits"
+	}
+
+	//Asking for no context takeover commits the client to it, whatever the server said
+	p.clientNoContextTakeover = p.clientNoContextTakeover || cfg.ClientNoContextTakeover
+	return p, ""
+}
+
+/*
+Validates permessage-deflate parameters, each of which may appear once.
+*/
+func parseDeflateParams(params []ExtensionParam) (*deflateParams, bool) {
+	var p deflateParams
+	seen := make(map[string]bool)
+	for _, param := range params {
+		if seen[param.Name] {
+			return nil, false
+		}
+		seen[param.Name] = true
+
+		var ok bool
+		switch param.Name {
+		case "server_no_context_takeover":
+			p.serverNoContextTakeover, ok = true, param.Value == ""
+		case "client_no_context_takeover":
+			p.clientNoContextTakeover, ok = true, param.Value == ""
+		case "server_max_window_bits":
+			p.serverMaxWindowBits, ok = parseWindowBits(param.Value)
+		case "client_max_window_bits":
+			//Without a value, the client only says it supports the parameter
+			p.clientMaxWindowBits, ok = maxWindowBits, true
+			if param.Value != "" {
+				p.clientMaxWindowBits, ok = parseWindowBits(param.Value)
+			}
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return &p, true
+}
+
+/*
+Parses a window size, a number of bits from 8 to 15 without leading zeros.
+*/
+func parseWindowBits(v string) (int, bool) {
+	if v == "" || v[0] == '0' {
+		return 0, false
+	}
+	bits, e := strconv.Atoi(v)
+	if e != nil || bits < minWindowBits || bits > maxWindowBits {
+		return 0, false
+	}
+	return bits, true
+}
+
+/*
+The permessage-deflate state of a connection.
+Writing is guarded by the connection's msgLock, reading happens from one goroutine at a time.
+*/
+type deflateState struct {
+	level     int
+	threshold int
+	enabled   bool
+
+	//Whether each side keeps its context between messages
+	writeTakeover bool
+	readTakeover  bool
+
+	//The window sizes each side compresses with, in bytes
+	writeWindow int
+	readWindow  int
+
+	//Kept between messages with context takeover, otherwise pooled
+	fw   *flate.Writer
+	wbuf bytes.Buffer
+
+	//The last messages read, the dictionary for the next one with context takeover
+	window []byte
+}
+
+/*
+Sets up compression for a connection with the negotiated parameters.
+*/
+func newDeflateState(p *deflateParams, cfg *Compression, client bool) *deflateState {
+	d := &deflateState{level: flate.DefaultCompression, enabled: true}
+	if cfg != nil {
+		if cfg.Level != 0 && checkLevel(cfg.Level) == nil {
+			d.level = cfg.Level
+		}
+		d.threshold = cfg.Threshold
+	}
+	if client {
+		d.writeTakeover, d.readTakeover = !p.clientNoContextTakeover, !p.serverNoContextTakeover
+		d.writeWindow, d.readWindow = window(p.clientMaxWindowBits), window(p.serverMaxWindowBits)
+	} else {
+		d.writeTakeover, d.readTakeover = !p.serverNoContextTakeover, !p.clientNoContextTakeover
+		d.writeWindow, d.readWindow = window(p.serverMaxWindowBits), window(p.clientMaxWindowBits)
+	}
+	return d
+}
+
+/*
+Returns the window size in bytes for a negotiated number of bits, zero meaning the maximum.
+*/
+func window(bits int) int {
+	if bits == 0 {
+		return maxWindow
+	}
+	return 1 << bits
+}
+
+/*
+Reports whether a message of n bytes should be compressed.
+*/
+func (d *deflateState) compresses(n int) bool {
+	//Go's compressor can't keep to a smaller window
+	return d.enabled && d.writeWindow == maxWindow && n >= d.threshold
+}
+
+/*
+Compresses a message, returning the payload to send. It is only valid until the next message is compressed.
+*/
+func (d *deflateState) compress(b []byte) ([]byte, error) {
+	fw := d.begin()
+	if _, e := fw.Write(b); e != nil {
+		return nil, e
+	}
+	return d.end(fw)
+}
+
+/*
+Starts compressing a message, written to the returned compressor. The compressed data collects in d.wbuf.
+*/
+func (d *deflateState) begin() *flate.Writer {
+	d.wbuf.Reset()
+	if d.fw != nil {
+		return d.fw
+	}
+	fw := getFlateWriter(&d.wbuf, d.level)
+	if d.writeTakeover {
+		d.fw = fw
+	}
+	return fw
+}
+
+/*
+Ends the message being compressed by fw, returning the compressed data not yet taken from d.wbuf.
+*/
+func (d *deflateState) end(fw *flate.Writer) ([]byte, error) {
+	if !d.writeTakeover {
+		defer putFlateWriter(fw, d.level)
+	}
+	if e := fw.Flush(); e != nil {
+		return nil, e
+	}
+	return bytes.TrimSuffix(d.wbuf.Bytes(), []byte(deflateSync)), nil
+}
+
+/*
+Sets the compression level for the following messages.
+*/
+func (d *deflateState) setLevel(level int) {
+	if level != d.level {
+		//Starting over loses the context, which the other end can cope with
+		d.level = level
+		d.fw = nil
+	}
+}
+
+/*
+Returns a reader decompressing the message read by src.
+*/
+func (d *deflateState) newReader(src *messageReader) *inflateReader {
+	var dict []byte
+	if d.readTakeover {
+		dict = d.window
+	}
+	r := io.MultiReader(src, strings.NewReader(deflateTail))
+	return &inflateReader{d: d, fr: getFlateReader(r, dict, d.readWindow), src: src}
+}
+
+/*
+Adds decompressed data to the window used as the next message's dictionary.
+*/
+func (d *deflateState) record(b []byte) {
+	d.window = append(d.window, b...)
+	if len(d.window) > 2*d.readWindow {
+		n := copy(d.window, d.window[len(d.window)-d.readWindow:])
+		d.window = d.window[:n]
+	}
+}
+
+/*
+Decompresses a message.
+*/
+type inflateReader struct {
+	d   *deflateState
+	fr  io.ReadCloser
+	src *messageReader
+}
+
+func (r *inflateReader) Read(p []byte) (int, error) {
+	n, e := r.fr.Read(p)
+	if r.d.readTakeover {
+		r.d.record(p[:n])
+	}
+
+	//Errors not coming from the connection mean the data itself is bad
+	if e != nil && e != io.EOF && r.src.err == nil && !isTimeout(e) {
+		e = errInvalidCompressed
+	}
+	return n, e
+}
+
+/*
+Returns the decompressor to the pool.
+*/
+func (r *inflateReader) Close() error {
+	flateReaderPool.Put(r.fr)
+	return nil
+}
+
+//Compressors are large, so they are shared between connections without context takeover. One pool per level.
+var flateWriterPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+var flateReaderPool sync.Pool
+
+func getFlateWriter(w io.Writer, level int) *flate.Writer {
+	if fw, ok := flateWriterPools[level-flate.HuffmanOnly].Get().(*flate.Writer); ok {
+		fw.Reset(w)
+		return fw
+	}
+	//The level was checked when it was set
+	fw, _ := flate.NewWriter(w, level)
+	return fw
+}
+
+func putFlateWriter(fw *flate.Writer, level int) {
+	flateWriterPools[level-flate.HuffmanOnly].Put(fw)
+}
+
+func getFlateReader(r io.Reader, dict []byte, size int) io.ReadCloser {
+	if len(dict) > size {
+		dict = dict[len(dict)-size:]
+	}
+	if fr, ok := flateReaderPool.Get().(io.ReadCloser); ok {
+		fr.(flate.Resetter).Reset(r, dict)
+		return fr
+	}
+	return flate.NewReaderDict(r, dict)
+}
+
+/*
+Checks a compression level, as accepted by compress/flate.
+*/
+func checkLevel(level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return fmt.Errorf("Invalid compression level %d.", level)
+	}
+	return nil
+}
+
+/*
+EnableWriteCompression turns compression of the following messages written to this connection on or off.
+It has no effect if compression was not negotiated.
+*/
+func (c *Conn) EnableWriteCompression(enable bool) {
+	c.lockMessages()
+	defer c.unlockMessages()
+	if c.deflate != nil {
+		c.deflate.enabled = enable
+	}
+}
+
+/*
+SetCompressionLevel sets the flate level used to compress the following messages written to this connection.
+It has no effect if compression was not negotiated.
+*/
+func (c *Conn) SetCompressionLevel(level int) error {
+	if e := checkLevel(level); e != nil {
+		return e
+	}
+	c.lockMessages()
+	defer c.unlockMessages()
+	if c.deflate != nil {
+		c.deflate.setLevel(level)
+	}
+	return nil
+}
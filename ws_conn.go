@@ -1,28 +1,135 @@
 package ws
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
+/*
+Message types, as returned by ReadMessage and accepted by WriteMessage.
+*/
+const (
+	TextMessage   = opText
+	BinaryMessage = opBinary
+)
+
+/*
+ErrCloseSent is returned when writing to a connection after a close frame was sent.
+*/
+var ErrCloseSent = errors.New("Close frame already sent.")
+
 /*
 A WebSocket connection.
 */
 type Conn struct {
-	nc      net.Conn
-	client  bool
-	id      int64
-	Handler Handler
-	server  *Server
+	nc           net.Conn
+	br           *bufio.Reader
+	client       bool
+	id           string
+	subprotocol  string
+	fragmentSize int
+	readLimit    int64
+	deflate      *deflateState
+	extensions   []ConnExtension
+	rsv          byte
+	reader       *messageStream
+	Handler      Handler
+	server       *Server
+
+	//OnClose is called on its own goroutine once the connection is closed
 	OnClose func(*Conn)
+
+	//Pings waiting for their pong, by payload
+	pingMu  sync.Mutex
+	pings   map[string]chan struct{}
+	pingSeq uint64
+
+	//Writes of whole messages, and of single frames, are serialized. msgLock holds a token while a message is written,
+	//a channel so that writers can give up waiting
+	msgLock chan struct{}
+	writeMu sync.Mutex
+
+	//Reused by every frame written, guarded by writeMu
+	header [maxHeaderSize]byte
+	mask   [4]byte
+	bufs   [2][]byte
+	vec    net.Buffers
+
+	//Held while reading, so Close knows whether it has to read the answer to its close frame itself
+	readMu sync.Mutex
+
+	//Deadlines set on the connection, and timeouts applied to each message
+	deadlineMu    sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	idleTimeout   time.Duration
+	readBroken    bool
+
+	//Set, atomically, once a frame was cut off while being written, after which nothing more can be written
+	writeBroken int32
+
+	//Close handshake state
+	closeSent     bool
+	closeTimeout  time.Duration
+	closeReceived chan struct{}
+	closeStatus   *CloseError
+	closeOnce     sync.Once
+
+	//Closed once the underlying connection is closed
+	done         chan struct{}
+	teardownOnce sync.Once
+}
+
+/*
+Creates a connection over nc, reading through br which may already hold buffered data.
+*/
+func newConn(nc net.Conn, br *bufio.Reader, client bool) *Conn {
+	if br == nil {
+		br = bufio.NewReader(nc)
+	}
+	return &Conn{nc: nc, br: br, client: client, msgLock: make(chan struct{}, 1), closeReceived: make(chan struct{}), done: make(chan struct{})}
+}
+
+/*
+Takes the right to write a message, waiting for the message being written.
+*/
+func (c *Conn) lockMessages() {
+	c.msgLock <- struct{}{}
+}
+
+/*
+Takes the right to write a message like lockMessages, giving up when ctx is done.
+*/
+func (c *Conn) lockMessagesContext(ctx context.Context) error {
+	select {
+	case c.msgLock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Conn) unlockMessages() {
+	<-c.msgLock
 }
 
 /*
-Get the unique ID associated with this connection.
+Get the unique ID associated with this connection by its server.
+Client connections have no ID.
 */
-func (c *Conn) Id() int64 {
+func (c *Conn) Id() string {
 	return c.id
 }
 
@@ -33,6 +140,13 @@ func (c *Conn) IsClient() bool {
 	return c.client
 }
 
+/*
+Returns the subprotocol negotiated during the handshake, or an empty string if there is none.
+*/
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
 /*
 Returns the base net.Conn interface belonging to this connection.
 */
@@ -42,61 +156,518 @@ func (c *Conn) Base() net.Conn {
 
 /*
 Reads a framed message to the connection and writes it to a Writer.
+Fragmented messages are reassembled, and control frames arriving between the fragments are handled.
+Returns a CloseError once the other end has closed the connection, or if it broke the protocol.
 */
 func (c *Conn) ReadTo(w io.Writer) error {
+	_, e := c.readMessage(w)
+	return e
+}
+
+/*
+ReadMessage reads the next message from the connection.
+Returns the message type, TextMessage or BinaryMessage, and its payload.
+*/
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	var buffer bytes.Buffer
+	msgType, e := c.readMessage(&buffer)
+	if e != nil {
+		return 0, nil, e
+	}
+	return msgType, buffer.Bytes(), nil
+}
+
+/*
+Reads the next message to w, returning its type.
+*/
+func (c *Conn) readMessage(w io.Writer) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	msgType, s, e := c.openMessage()
+	if e != nil {
+		return 0, e
+	}
+	if _, e = io.Copy(w, readFunc(s.read)); e != nil {
+		//The caller can't pick up where the message stopped
+		c.readBroken = true
+		return 0, e
+	}
+	return msgType, nil
+}
+
+/*
+Starts reading the next message, returning its type and a reader for its payload.
+Whatever is left of the previous message is skipped first.
+*/
+func (c *Conn) nextMessage() (int, io.Reader, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	msgType, s, e := c.openMessage()
+	if e != nil {
+		return 0, nil, e
+	}
+	return msgType, s, nil
+}
+
+/*
+Starts reading the next message like nextMessage. Called with readMu held.
+*/
+func (c *Conn) openMessage() (msgType int, s *messageStream, e error) {
 
 	var f DataFrame
-	var e error
 
-	//Read frame from connection
-	if e = f.ReadFrom(c.nc); e != nil {
+	//Once the close frame was read, by Close or another reader, nothing else follows it
+	select {
+	case <-c.closeReceived:
+		return 0, nil, c.closeStatus
+	default:
+	}
+	if c.readBroken {
+		return 0, nil, errReadInterrupted
+	}
+	if c.reader != nil {
+		if _, e = io.Copy(io.Discard, readFunc(c.reader.read)); e != nil {
+			return 0, nil, e
+		}
+		c.reader = nil
+	}
+
+	//Wait at most the idle timeout for the message, then at most the read timeout to read it
+	timeouts := c.idleTimeout > 0 || c.readTimeout > 0
+	if timeouts {
+		c.extendRead(c.idleTimeout)
+	}
+
+	//Read the first frame of the message
+	if e = c.nextFrame(&f); e != nil {
+		return 0, nil, e
+	}
+	if f.op == opContinue {
+		return 0, nil, c.fail(CloseProtocolError, "continuation frame without a message to continue")
+	}
+	if e = c.checkRSV(&f, true); e != nil {
+		return 0, nil, e
+	}
+	msgType = int(f.op)
+
+	if timeouts {
+		c.extendRead(c.readTimeout)
+	}
+
+	msg := &messageReader{c: c, f: &f}
+	if e = msg.start(); e != nil {
+		c.readBroken = true
+		return 0, nil, e
+	}
+	s = &messageStream{c: c, msg: msg, src: msg}
+
+	if c.deflate != nil && f.rsv&rsv1 != 0 {
+		s.inflate = c.deflate.newReader(msg)
+		s.src = s.inflate
+	}
+
+	//Messages that were transformed are limited by their final size too
+	if (s.inflate != nil || len(c.extensions) > 0) && c.readLimit > 0 {
+		s.limited, s.left = true, c.readLimit
+	}
+
+	//Text must be valid UTF-8, even when a character is split between fragments
+	if msgType == TextMessage {
+		s.text = new(utf8Validator)
+	}
+
+	c.reader = s
+	return msgType, s, nil
+}
+
+/*
+Reads the payload of a message, across its fragments, unmasking it if needed.
+Control frames in between are handled as they come.
+*/
+type messageReader struct {
+	c         *Conn
+	f         *DataFrame
+	remaining int
+	pos       int
+	size      int64
+	last      bool
+	err       error
+
+	//With extensions, each frame is read whole and transformed before it is read from
+	buffered bool
+	buf      []byte
+}
+
+/*
+Starts reading the payload of the frame in r.f, refusing it if the message would go over the read limit.
+*/
+func (r *messageReader) start() error {
+	r.size += int64(r.f.length)
+	if r.c.readLimit > 0 && r.size > r.c.readLimit {
+		r.err = r.c.fail(CloseMessageTooBig, "message too big")
+		return r.err
+	}
+	r.remaining = r.f.length
+	r.pos = 0
+	r.last = r.f.fin == msbOn
+	if len(r.c.extensions) > 0 {
+		r.err = r.transform()
+		if r.err != nil && isTimeout(r.err) {
+			//Part of the frame was read, and is lost
+			r.c.readBroken = true
+		}
+	}
+	return r.err
+}
+
+/*
+Reads the whole payload of the frame in r.f and passes it through the connection's extensions.
+The RSV bits of r.f are updated to what the extensions left.
+*/
+func (r *messageReader) transform() error {
+	//Without a read limit, frames still have to fit in memory
+	if r.c.readLimit <= 0 && r.f.length > maxTransformedFrame {
+		return r.c.fail(CloseMessageTooBig, "frame too big")
+	}
+
+	//The buffer grows as the payload arrives, rather than trusting the length in the header
+	payload, e := io.ReadAll(io.LimitReader(r.c.br, int64(r.f.length)))
+	if e == nil && len(payload) < r.f.length {
+		e = io.ErrUnexpectedEOF
+	}
+	if e != nil {
+		return e
+	}
+	if r.f.masked == msbOn {
+		maskBytes(r.f.mask, 0, payload)
+	}
+
+	frame := Frame{Fin: r.f.fin == msbOn, RSV: r.f.rsv, Opcode: r.f.op, Payload: payload}
+	if e := r.c.readExtensions(&frame); e != nil {
 		return e
 	}
+	r.f.rsv = frame.RSV
+	r.buffered, r.buf, r.remaining = true, frame.Payload, len(frame.Payload)
+	return nil
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	//Move on to the next fragment once this one is read. r.f may hold a control frame read in between.
+	for r.remaining == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+		if e := r.c.nextFrame(r.f); e != nil {
+			r.fault(e)
+			return 0, e
+		}
+		if r.f.op != opContinue {
+			r.err = r.c.fail(CloseProtocolError, "new message before the previous one was finished")
+			return 0, r.err
+		}
+		if r.err = r.c.checkRSV(r.f, false); r.err != nil {
+			return 0, r.err
+		}
+		if e := r.start(); e != nil {
+			return 0, e
+		}
+	}
+
+	if r.buffered {
+		n := copy(p, r.buf)
+		r.buf = r.buf[n:]
+		r.remaining -= n
+		return n, nil
+	}
+
+	if len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, e := r.c.br.Read(p)
+	if r.f.masked == msbOn {
+		r.pos = maskBytes(r.f.mask, r.pos, p[:n])
+	}
+	r.remaining -= n
+	if e == io.EOF {
+		e = io.ErrUnexpectedEOF
+	}
+	r.fault(e)
+	return n, e
+}
 
-	//Evaluate opcode
-	if f.op > opBinary {
+/*
+Records a read error, which ends the message.
+A timeout does not, unless it cut off a frame header, since reading can carry on where it stopped.
+*/
+func (r *messageReader) fault(e error) {
+	if e != nil && (!isTimeout(e) || r.c.readBroken) {
+		r.err = e
+	}
+}
+
+/*
+Reads frames from the connection into f until a data frame is read, handling any control frames on the way.
+Only the header of the data frame is read.
+*/
+func (c *Conn) nextFrame(f *DataFrame) error {
+	for {
+		//Read frame from connection
+		if n, e := f.ReadFrom(c.br); e != nil {
+			if e == ErrInvalidLength {
+				return c.fail(CloseProtocolError, "invalid frame length")
+			}
+			if n > 0 {
+				c.readBroken = true
+			}
+			return e
+		}
+
+		//Evaluate opcode
 		switch f.op {
-		case opClose:
-			//TODO: This closes WHILE sending a response Close frame
-			fmt.Println("Received close opcode.")
-			c.Close()
-			return nil
-		case opPing:
+		case opContinue, opText, opBinary:
 			return nil
+		case opClose, opPing, opPong:
+			if e := c.checkRSV(f, false); e != nil {
+				return e
+			}
+			if f.fin != msbOn {
+				return c.fail(CloseProtocolError, "fragmented control frame")
+			}
+			if f.length > maxControlPayload {
+				return c.fail(CloseProtocolError, "control frame too long")
+			}
+			var payload bytes.Buffer
+			if e := c.readPayload(f, &payload); e != nil {
+				c.readBroken = true
+				return e
+			}
+			switch f.op {
+			case opClose:
+				return c.receiveClose(payload.Bytes())
+			case opPing:
+				c.pong(payload.Bytes())
+			case opPong:
+				c.receivePong(payload.Bytes())
+			}
 		default:
-			return nil
+			return c.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %d", f.op))
 		}
 	}
+}
+
+/*
+Checks the RSV bits of a frame read from the connection: only bits used by an extension may be set,
+and the RSV1 of permessage-deflate only on the first frame of a message.
+*/
+func (c *Conn) checkRSV(f *DataFrame, first bool) error {
+	if f.rsv&^c.rsv != 0 {
+		return c.fail(CloseProtocolError, "unexpected RSV bits")
+	}
+	if c.deflate != nil && f.rsv&rsv1 != 0 && !first {
+		return c.fail(CloseProtocolError, "RSV1 set on a frame that does not start a message")
+	}
+	return nil
+}
 
-	if !c.client {
+/*
+Reads the payload described by f from the connection, unmasking it if needed, and writes it to w.
+*/
+func (c *Conn) readPayload(f *DataFrame, w io.Writer) error {
+	if f.masked == msbOn {
 		//Read and decode into writer
-		if e = f.DecodeTo(c.nc, w); e != nil {
-			return e
+		return f.DecodeTo(c.br, w)
+	}
+
+	//Read straight into writer
+	_, e := io.CopyN(w, c.br, int64(f.length))
+	return e
+}
+
+/*
+SetReadLimit sets the maximum size in bytes of a message read from this connection.
+A message over the limit closes the connection with CloseMessageTooBig. A limit of zero or less allows any size.
+*/
+func (c *Conn) SetReadLimit(n int64) {
+	c.readLimit = n
+}
+
+/*
+Sets the maximum payload size of the frames written to this connection.
+Longer messages are sent as several fragments. A size of zero or less sends every message in a single frame.
+*/
+func (c *Conn) SetFragmentSize(n int) {
+	c.fragmentSize = n
+}
+
+/*
+Writes a framed message to the connection as a text message, which must be valid UTF-8.
+The message is split into fragments if it is longer than the fragment size.
+Returns the number of payload bytes written, and the error that stopped the write if it is less than len(b).
+*/
+func (c *Conn) Write(b []byte) (int, error) {
+	return c.writeMessage(opText, b)
+}
+
+/*
+WriteMessage writes a message of msgType, TextMessage or BinaryMessage, to the connection.
+The message is split into fragments if it is longer than the fragment size.
+*/
+func (c *Conn) WriteMessage(msgType int, data []byte) error {
+	if msgType != TextMessage && msgType != BinaryMessage {
+		return fmt.Errorf("Invalid message type %d.", msgType)
+	}
+	_, e := c.writeMessage(byte(msgType), data)
+	return e
+}
+
+/*
+Writes b as a message with opcode op, in fragments if needed.
+Returns the number of payload bytes in the frames that were written.
+Returns ErrInvalidUTF8 without writing anything if a text message is not valid UTF-8.
+Messages written concurrently are sent one after another, control frames may still be sent between their fragments.
+*/
+func (c *Conn) writeMessage(op byte, b []byte) (int, error) {
+	if op == opText && !utf8.Valid(b) {
+		return 0, ErrInvalidUTF8
+	}
+
+	c.lockMessages()
+	defer c.unlockMessages()
+	n, _, e := c.sendMessage(op, b)
+	return n, e
+}
+
+/*
+Sends b as a message like writeMessage. Called holding msgLock.
+Also reports whether any frame of the message was written, after which the message can't be taken back.
+*/
+func (c *Conn) sendMessage(op byte, b []byte) (int, bool, error) {
+	//A compressed message is flagged on its first frame only
+	var rsv byte
+	size := len(b)
+	compressed := c.deflate != nil && c.deflate.compresses(size)
+	if compressed {
+		var e error
+		if b, e = c.deflate.compress(b); e != nil {
+			return 0, false, e
+		}
+		rsv = rsv1
+	}
+
+	written, sent := 0, false
+	stopped := func(e error) (int, bool, error) {
+		//Part of a compressed message doesn't map to a count of the caller's bytes
+		if compressed {
+			return 0, sent, e
+		}
+		return written, sent, e
+	}
+	for {
+		chunk := b
+		if c.fragmentSize > 0 && len(chunk) > c.fragmentSize {
+			chunk = chunk[:c.fragmentSize]
+		}
+		b = b[len(chunk):]
+
+		if e := c.writeFragment(len(b) == 0, rsv, op, chunk); e != nil {
+			return stopped(e)
 		}
-	} else {
-		//Read straight into writer
-		if _, e = io.CopyN(w, c.nc, int64(f.length)); e != nil {
+		written, sent = written+len(chunk), true
+
+		if len(b) == 0 {
+			return size, true, nil
+		}
+		op, rsv = opContinue, 0
+	}
+}
+
+/*
+Writes one data frame of a message, after passing it through the connection's extensions.
+*/
+func (c *Conn) writeFragment(fin bool, rsv, op byte, b []byte) error {
+	if len(c.extensions) > 0 {
+		frame := Frame{Fin: fin, RSV: rsv, Opcode: op, Payload: b}
+		if e := c.writeExtensions(&frame); e != nil {
 			return e
 		}
+		rsv, b = frame.RSV, frame.Payload
 	}
-	return nil
+	bits := rsv
+	if fin {
+		bits |= msbOn
+	}
+	return c.writeFrame(bits, op, b)
 }
 
 /*
-Writes a framed message to the connection.
+Writes a frame and its payload to the connection as one unit, masking the payload if this is a client.
+Header and payload go out in a single vectored write, the payload is not copied unless it has to be masked.
+bits holds the FIN and RSV bits of the frame. No frames can be written once a close frame was sent.
 */
-func (c *Conn) Write(b []byte) (int, error) {
-	frame := NewFrame(b)
-	if !c.client {
-		//FIXME: SHould i be writing all at once? Sometimes th client reads just the frame
-		frame.WriteTo(c.nc)
-		c.nc.Write(b)
-	} else {
-		frame.GenerateMask()
-		frame.WriteTo(c.nc)
-		frame.Encode(b, c.nc)
+func (c *Conn) writeFrame(bits, op byte, b []byte) error {
+	return c.writeFrameBy(time.Time{}, bits, op, b)
+}
+
+/*
+Writes a frame like writeFrame, giving up at deadline unless it is zero.
+*/
+func (c *Conn) writeFrameBy(deadline time.Time, bits, op byte, b []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if atomic.LoadInt32(&c.writeBroken) != 0 {
+		return errWriteInterrupted
+	}
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+	if c.writeTimeout > 0 || !deadline.IsZero() {
+		c.limitWrite(c.writeTimeout, deadline)
 	}
-	return 0, nil
+	if !deadline.IsZero() {
+		defer c.limitWrite(0, time.Time{})
+	}
+
+	var mask []byte
+	if c.client {
+		mask = c.mask[:]
+		if _, e := rand.Read(mask); e != nil {
+			return e
+		}
+
+		//Mask a copy, the caller still owns b
+		buf := getMaskBuffer(len(b))
+		defer putMaskBuffer(buf)
+		copy(*buf, b)
+		maskBytes(mask, 0, *buf)
+		b = *buf
+	}
+
+	c.bufs = [2][]byte{appendHeader(c.header[:0], bits|op, len(b), mask), b}
+	c.vec = c.bufs[:]
+	n, e := c.vec.WriteTo(c.nc)
+	c.bufs = [2][]byte{}
+	if e != nil && n > 0 {
+		//The other end would read whatever follows as the rest of this frame
+		atomic.StoreInt32(&c.writeBroken, 1)
+	}
+	return e
+}
+
+/*
+Returns true if a frame was cut off while being written.
+*/
+func (c *Conn) writeInterrupted() bool {
+	return atomic.LoadInt32(&c.writeBroken) != 0
 }
 
 /*
@@ -108,53 +679,59 @@ func (c *Conn) WriteString(msg string) (int, error) {
 
 /*
 Listen on connection continuously, routing to messages to handler.
+Returns a CloseError describing how the connection was closed.
 */
 func (c *Conn) Handle(handler func(*Conn, []byte)) error {
+	if handler == nil {
+		return c.HandleMessage(nil)
+	}
+	return c.HandleMessage(func(c *Conn, _ int, msg []byte) {
+		handler(c, msg)
+	})
+}
 
-	var e error
+/*
+HandleMessage listens on connection continuously like Handle, also passing the type of each message to handler.
+*/
+func (c *Conn) HandleMessage(handler func(c *Conn, msgType int, msg []byte)) error {
 
 	for {
-		var buffer bytes.Buffer
-		e = c.ReadTo(&buffer)
+		msgType, msg, e := c.ReadMessage()
 		if e != nil {
-			fmt.Printf("Error reading from connection: %s\n", e)
-			return c.Close()
+			return c.closeError(e)
 		}
 
 		if c.Handler != nil {
-			if c.Handler.Handle(c, buffer.Bytes()) {
+			if c.Handler.Handle(c, msg) {
 				continue
 			}
 		}
 
 		if handler != nil {
-			handler(c, buffer.Bytes())
+			handler(c, msgType, msg)
 		}
 	}
 }
 
 /*
-Closes a websocket connection.
+Returns the CloseError for a failed read, closing the connection if it was lost or timed out.
 */
-func (c *Conn) Close() error {
-
-	fmt.Println("Connection closed.")
-
-	//Close callback
-	if c.OnClose != nil {
-		c.OnClose(c)
+func (c *Conn) closeError(e error) error {
+	var ce *CloseError
+	if errors.As(e, &ce) {
+		return ce
 	}
-
-	//Send a close frame
-	df := NewFrame(nil)
-	df.op = opClose
-	df.WriteTo(c.nc)
-
-	//If its a server connection, remove from clients
-	if c.server != nil {
-		delete(c.server.Clients, c.id)
-		fmt.Printf("Client close, number of clients is now %v.\n", len(c.server.Clients))
+	if isTimeout(e) {
+		return c.fail(CloseGoingAway, "timeout")
 	}
+	c.teardown()
+	return &CloseError{CloseAbnormal, e.Error()}
+}
 
-	return c.nc.Close()
+/*
+Closes a websocket connection with a normal close status.
+See CloseWithCode.
+*/
+func (c *Conn) Close() error {
+	return c.CloseWithCode(CloseNormal, "")
 }
@@ -1,9 +1,12 @@
 package ws
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"io"
+	"sync"
 )
 
 const (
@@ -16,13 +19,28 @@ const (
 	opPing       = 0x09
 	opPong       = 0x0A
 	selectOp     = 0x0F //15
+	selectRsv    = 0x70 //112
+	rsv1         = 0x40 //64
 	selectPl     = 0x7f //?
 	sigUint16    = 0x7E //126
 	sigUint64    = 0x7F //127
 	msbOn        = 0x80 //128
 	stdResponse  = 0x81 //129
+
+	maxControlPayload = 125
+
+	//Largest buffer used to mask a payload, longer payloads are masked in chunks
+	maxMaskChunk = 32 * 1024
+
+	//First two bytes, 64-bit length and mask
+	maxHeaderSize = 2 + 8 + 4
 )
 
+/*
+ErrInvalidLength is returned when reading a frame whose 64-bit payload length has the most significant bit set.
+*/
+var ErrInvalidLength = errors.New("Frame length has the most significant bit set.")
+
 type DataFrame struct {
 	fin    byte
 	op     byte
@@ -31,12 +49,13 @@ type DataFrame struct {
 	masked byte
 	mask   []byte
 	length int
+	rsv    byte
 }
 
-//Construct a dataframe for message.
+//Construct a text dataframe for message. Set op for other frame types.
 func NewFrame(message []byte) *DataFrame {
 	var f DataFrame
-	f = DataFrame{msbOn, 1, 0, nil, 0, nil, 0}
+	f = DataFrame{msbOn, 1, 0, nil, 0, nil, 0, 0}
 	if message != nil {
 		f.SetDataLength(len(message))
 	}
@@ -67,57 +86,55 @@ func (f *DataFrame) SetDataLength(l int) {
 }
 
 /*
-Reads a WebSocket data frame from reader into this data frame.
-Returns an error if the frame could not be read.
+Reads the header of a WebSocket data frame from reader into this data frame, leaving the payload unread.
+Returns the number of bytes read, and an error if the frame could not be read.
 */
-func (f *DataFrame) ReadFrom(r io.Reader) error {
+func (f *DataFrame) ReadFrom(r io.Reader) (int64, error) {
 
 	var e error
-	var b []byte
-	b = make([]byte, 1)
+	var n int
+	var read int64
+	b := make([]byte, 2)
 
-	//FIN + Opcode
-	if _, e = r.Read(b); e != nil {
-		return e
+	//FIN + Opcode, Hash bit + Payload length
+	n, e = io.ReadFull(r, b)
+	read += int64(n)
+	if e != nil {
+		return read, e
 	}
 
 	f.fin = (msbOn & b[0])
 	f.op = selectOp & b[0] //15
+	f.rsv = selectRsv & b[0]
 
-	//Evaluate OpCode
-	if f.op > opBinary {
-		return nil
-	}
-
-	//Get Hash bit and Payload length
-	if _, e = r.Read(b); e != nil {
-		return e
-	}
-
-	f.masked = msbOn & b[0]
-	if f.masked != msbOn { //128, MSBON
-		//FIXME: Create custom error type for unuhashed
-		//TODO: We don't want to end here because what if its a client that is using this? We'll check masked before decoding
-		//return e
-	}
+	//Masked frames come from clients, we check masked before decoding
+	f.masked = msbOn & b[1]
 
-	f.pl = selectPl & b[0]
+	f.pl = selectPl & b[1]
 	switch f.pl {
 	case sigUint16:
 		f.plext = make([]byte, 2)
-		if _, e = io.ReadFull(r, f.plext); e != nil {
-			return e
+		n, e = io.ReadFull(r, f.plext)
+		read += int64(n)
+		if e != nil {
+			return read, e
 		}
 		f.length = int(binary.BigEndian.Uint16(f.plext))
 	case sigUint64:
 		f.plext = make([]byte, 8)
-		if _, e = io.ReadFull(r, f.plext); e != nil {
-			return e
+		n, e = io.ReadFull(r, f.plext)
+		read += int64(n)
+		if e != nil {
+			return read, e
+		}
+		//The length is at most 2^63-1, the most significant bit must be 0
+		if f.plext[0]&msbOn != 0 {
+			return read, ErrInvalidLength
 		}
 		f.length = int(binary.BigEndian.Uint64(f.plext))
 	default:
 		f.plext = nil
-		f.length = int(0x7F & b[0])
+		f.length = int(f.pl)
 	}
 
 	//Read the mask if it has one
@@ -125,39 +142,50 @@ func (f *DataFrame) ReadFrom(r io.Reader) error {
 		if f.mask == nil {
 			f.mask = make([]byte, 4)
 		}
-		if _, e = io.ReadFull(r, f.mask); e != nil {
-			return e
+		n, e = io.ReadFull(r, f.mask)
+		read += int64(n)
+		if e != nil {
+			return read, e
 		}
 	}
 
-	return nil
+	return read, nil
 }
 
 /*
 Writes this WebSocket data frame to a writer.
-Returns an error if the frame could not be written.
+Returns the number of bytes written, and an error if the frame could not be written.
 */
-func (f *DataFrame) WriteTo(w io.Writer) error {
-
-	//fmt.Printf("FIN:%b\n", f.fin)
-	//fmt.Printf("OP:%b\n", f.op)
-	//fmt.Printf("1st:%b\n", (f.fin | f.op))
-
-	var e error
-	if _, e = w.Write([]byte{(f.fin | f.op), (f.masked | f.pl)}); e != nil {
-		return e
+func (f *DataFrame) WriteTo(w io.Writer) (int64, error) {
+	var header [maxHeaderSize]byte
+	b := append(header[:0], f.fin|f.rsv|f.op, f.masked|f.pl)
+	b = append(b, f.plext...)
+	if f.masked == msbOn { //0x80, MSB on
+		b = append(b, f.mask...)
 	}
-	if f.plext != nil {
-		if _, e = w.Write(f.plext); e != nil {
-			return e
-		}
+	n, e := w.Write(b)
+	return int64(n), e
+}
+
+/*
+Appends a frame header to b: the first byte holding FIN, the RSV bits and the opcode, the payload length, and the mask if there is one.
+*/
+func appendHeader(b []byte, first byte, length int, mask []byte) []byte {
+	var masked byte
+	if mask != nil {
+		masked = msbOn
 	}
-	if f.masked == msbOn { //0x80, MSB on
-		if _, e = w.Write(f.mask); e != nil {
-			return e
-		}
+	switch {
+	case length <= maxControlPayload:
+		b = append(b, first, masked|byte(length))
+	case length <= 65535:
+		b = append(b, first, masked|sigUint16)
+		b = binary.BigEndian.AppendUint16(b, uint16(length))
+	default:
+		b = append(b, first, masked|sigUint64)
+		b = binary.BigEndian.AppendUint64(b, uint64(length))
 	}
-	return nil
+	return append(b, mask...)
 }
 
 /*
@@ -165,15 +193,11 @@ Reads an encoded WebSocket payload from reader, decodes it into a byte slice.
 Returns an error if the data was not written.
 */
 func (f *DataFrame) Decode(r io.Reader, w []byte) error {
-	//Read and decode the payload byte by byte
-	var e error
-	b := make([]byte, 1)
-	for i := 0; i < f.length; i++ {
-		if _, e = r.Read(b); e != nil {
-			return e
-		}
-		w[i] = b[0] ^ f.mask[i%4]
+	//Read the whole payload, then unmask it in place
+	if _, e := io.ReadFull(r, w[:f.length]); e != nil {
+		return e
 	}
+	maskBytes(f.mask, 0, w[:f.length])
 	return nil
 }
 
@@ -182,19 +206,7 @@ Reads an encoded WebSocket payload from reader, decodes it, and writes it to a W
 Returns an error if the data was not written.
 */
 func (f *DataFrame) DecodeTo(r io.Reader, w io.Writer) error {
-	//Read and decode the payload byte by byte
-	var e error
-	b := make([]byte, 1)
-	for i := 0; i < f.length; i++ {
-		if _, e = r.Read(b); e != nil {
-			return e
-		}
-		b[0] = b[0] ^ f.mask[i%4]
-		if _, e = w.Write(b); e != nil {
-			return e
-		}
-	}
-	return nil
+	return f.maskTo(r, w)
 }
 
 /*
@@ -220,29 +232,95 @@ func (f *DataFrame) GenerateMask() error {
 Encodes a message using the current mask, and writes the result to a Writer.
 */
 func (f *DataFrame) Encode(m []byte, w io.Writer) error {
-	b := make([]byte, 1)
-	for i := 0; i < f.length; i++ {
-		b[0] = m[i] ^ f.mask[i%4]
-		if _, e := w.Write(b); e != nil {
-			return e
-		}
-	}
-	return nil
+	return f.maskTo(bytes.NewReader(m[:f.length]), w)
 }
 
 /*
 Encodes a message from reader using the current mask, the length of which is denoted by the frame, and writes the result to a Writer.
 */
 func (f *DataFrame) EncodeTo(r io.Reader, w io.Writer) error {
-	b := make([]byte, 1)
-	for i := 0; i < f.length; i++ {
-		if _, e := r.Read(b); e != nil {
+	return f.maskTo(r, w)
+}
+
+/*
+Copies the payload from r to w in chunks, applying the mask to each.
+Masking is its own inverse, so this both encodes and decodes.
+*/
+func (f *DataFrame) maskTo(r io.Reader, w io.Writer) error {
+	size := f.length
+	if size > maxMaskChunk {
+		size = maxMaskChunk
+	}
+	pooled := getMaskBuffer(size)
+	defer putMaskBuffer(pooled)
+	buf := *pooled
+
+	pos := 0
+	for remaining := f.length; remaining > 0; {
+		chunk := buf
+		if remaining < len(chunk) {
+			chunk = chunk[:remaining]
+		}
+		if _, e := io.ReadFull(r, chunk); e != nil {
 			return e
 		}
-		b[0] = b[0] ^ f.mask[i%4]
-		if _, e := w.Write(b); e != nil {
+		pos = maskBytes(f.mask, pos, chunk)
+		if _, e := w.Write(chunk); e != nil {
 			return e
 		}
+		remaining -= len(chunk)
 	}
 	return nil
 }
+
+/*
+XORs b in place with mask, starting pos bytes into the mask.
+Works on 8 bytes at a time, returns the mask position following b.
+*/
+func maskBytes(mask []byte, pos int, b []byte) int {
+	//Repeat the mask, rotated to pos, over a whole word
+	if len(b) >= 8 {
+		var k [8]byte
+		for i := range k {
+			k[i] = mask[(pos+i)&3]
+		}
+		key := binary.LittleEndian.Uint64(k[:])
+
+		//Words are a multiple of the mask's length, so pos stays the same
+		n := len(b) &^ 7
+		for i := 0; i < n; i += 8 {
+			binary.LittleEndian.PutUint64(b[i:], binary.LittleEndian.Uint64(b[i:])^key)
+		}
+		b = b[n:]
+	}
+
+	//The rest byte by byte
+	for i := range b {
+		b[i] ^= mask[pos&3]
+		pos++
+	}
+	return pos & 3
+}
+
+//Buffers that client payloads are masked into, so the caller's slice is left alone
+var maskPool sync.Pool
+
+/*
+Returns a pooled buffer of n bytes.
+*/
+func getMaskBuffer(n int) *[]byte {
+	buf, _ := maskPool.Get().(*[]byte)
+	if buf == nil || cap(*buf) < n {
+		b := make([]byte, n)
+		buf = &b
+	}
+	*buf = (*buf)[:n]
+	return buf
+}
+
+/*
+Returns a buffer from getMaskBuffer to the pool.
+*/
+func putMaskBuffer(buf *[]byte) {
+	maskPool.Put(buf)
+}
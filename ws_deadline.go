@@ -0,0 +1,169 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+	"unicode/utf8"
+)
+
+//A deadline in the past, to interrupt blocked reads and writes
+var aLongTimeAgo = time.Unix(1, 0)
+
+//Returned when reading from a connection whose last message was interrupted
+var errReadInterrupted = errors.New("Connection can't be read after an interrupted message.")
+
+//Returned when writing to a connection after a frame was cut off
+var errWriteInterrupted = errors.New("Connection can't be written after an interrupted frame.")
+
+/*
+SetReadDeadline sets the deadline for reading from the connection. A zero value means reads do not time out.
+If the deadline passes partway through a message read with NextReader, the reader carries on where it stopped once the deadline is moved.
+The connection can't be read from again if the message was read with ReadMessage or ReadTo, if it was compressed, or if a frame header was cut off.
+*/
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	return c.nc.SetReadDeadline(t)
+}
+
+/*
+SetWriteDeadline sets the deadline for writing to the connection. A zero value means writes do not time out.
+If a frame was partially written when the deadline passed, the connection is broken and should be closed.
+*/
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.writeDeadline = t
+	return c.nc.SetWriteDeadline(t)
+}
+
+/*
+ReadMessageContext reads the next message like ReadMessage, giving up when ctx is done.
+If ctx is done before the message started arriving, the connection can still be read from.
+If the message was cut off, it can't be recovered and the connection is closed.
+*/
+func (c *Conn) ReadMessageContext(ctx context.Context) (int, []byte, error) {
+	stop := c.watch(ctx, &c.readDeadline, c.nc.SetReadDeadline)
+	msgType, msg, e := c.ReadMessage()
+	stop()
+
+	if e != nil && ctx.Err() != nil {
+		if c.readBroken {
+			c.teardown()
+		}
+		return 0, nil, ctx.Err()
+	}
+	return msgType, msg, e
+}
+
+/*
+WriteMessageContext writes a message like WriteMessage, giving up when ctx is done.
+If ctx is done while waiting for other messages to be written, nothing is sent and the connection can still be written to.
+The connection is closed if the write was cut off, since the other end could not make sense of the rest.
+*/
+func (c *Conn) WriteMessageContext(ctx context.Context, msgType int, data []byte) error {
+	if msgType != TextMessage && msgType != BinaryMessage {
+		return fmt.Errorf("Invalid message type %d.", msgType)
+	}
+	if msgType == TextMessage && !utf8.Valid(data) {
+		return ErrInvalidUTF8
+	}
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+
+	//The deadline is shared with other writers, so it is only moved once this message is the one being written
+	if e := c.lockMessagesContext(ctx); e != nil {
+		return e
+	}
+	defer c.unlockMessages()
+	stop := c.watch(ctx, &c.writeDeadline, c.nc.SetWriteDeadline)
+	_, sent, e := c.sendMessage(byte(msgType), data)
+	stop()
+
+	if e != nil && ctx.Err() != nil {
+		if sent || c.writeInterrupted() {
+			c.teardown()
+		}
+		return ctx.Err()
+	}
+	return e
+}
+
+/*
+Bounds reads or writes by ctx until the returned function is called, by setting the deadline into the past when the context is done.
+The context's own deadline is not copied over, so a timed out operation always sees ctx.Err(). The returned function restores the deadline.
+*/
+func (c *Conn) watch(ctx context.Context, deadline *time.Time, set func(time.Time) error) func() {
+	c.deadlineMu.Lock()
+	saved := *deadline
+	active := true
+	c.deadlineMu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() {
+		c.deadlineMu.Lock()
+		defer c.deadlineMu.Unlock()
+		if active {
+			*deadline = aLongTimeAgo
+			set(aLongTimeAgo)
+		}
+	})
+
+	return func() {
+		stop()
+		c.deadlineMu.Lock()
+		defer c.deadlineMu.Unlock()
+		active = false
+		*deadline = saved
+		set(saved)
+	}
+}
+
+/*
+Returns true if e is a timeout.
+*/
+func isTimeout(e error) bool {
+	var ne net.Error
+	return errors.As(e, &ne) && ne.Timeout()
+}
+
+/*
+Sets the read deadline of the underlying connection timeout from now, or to the connection's read deadline if it is earlier.
+*/
+func (c *Conn) extendRead(timeout time.Duration) {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.nc.SetReadDeadline(earliest(c.readDeadline, timeout))
+}
+
+/*
+Sets the write deadline of the underlying connection timeout from now, or to limit or the connection's write deadline if either is earlier.
+A zero timeout or limit is ignored.
+*/
+func (c *Conn) limitWrite(timeout time.Duration, limit time.Time) {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	d := earliest(c.writeDeadline, timeout)
+	if !limit.IsZero() && (d.IsZero() || limit.Before(d)) {
+		d = limit
+	}
+	c.nc.SetWriteDeadline(d)
+}
+
+/*
+Returns timeout from now, or t if it is earlier or timeout is not positive.
+*/
+func earliest(t time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return t
+	}
+	d := time.Now().Add(timeout)
+	if t.IsZero() || d.Before(t) {
+		return d
+	}
+	return t
+}
@@ -0,0 +1,349 @@
+package ws
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+/*
+RSV bits of the first byte of a frame, for use by extensions.
+*/
+const (
+	RSV1 = rsv1
+	RSV2 = 0x20
+	RSV3 = 0x10
+)
+
+//Frames passed through extensions are read whole. Without a read limit, larger ones close the connection with CloseMessageTooBig.
+const maxTransformedFrame = 64 << 20
+
+/*
+An Extension adds to the WebSocket protocol, once negotiated through the Sec-WebSocket-Extensions header.
+Give extensions to a Dialer to offer them, or to an Upgrader or Server to accept them.
+*/
+type Extension interface {
+	//Name is the extension's token in Sec-WebSocket-Extensions.
+	Name() string
+
+	//Offer returns the parameters a client offers, as they follow the name in the header, such as "mode=fast". It may be empty.
+	Offer() string
+
+	//Accept is called by a server for each offer of the extension, in the client's order of preference.
+	//It returns the parameters to respond with and the extension's state for the new connection, or false to decline the offer.
+	Accept(params []ExtensionParam) (string, ConnExtension, bool)
+
+	//Confirm is called by a client with the parameters of the server's response. An error fails the handshake.
+	Confirm(params []ExtensionParam) (ConnExtension, error)
+}
+
+/*
+An ExtensionParam is a parameter of an extension in Sec-WebSocket-Extensions. Value is empty if the parameter has none.
+*/
+type ExtensionParam struct {
+	Name  string
+	Value string
+}
+
+/*
+A ConnExtension is an Extension negotiated for one connection. It transforms the data frames sent and received.
+Frames are transformed one at a time, as written by one goroutine and read by one goroutine.
+Received frames are read whole before they are transformed, so they can't be larger than the read limit, or 64MiB without one.
+*/
+type ConnExtension interface {
+	//RSV returns the RSV bits the extension uses. Frames received with bits no extension uses fail the connection.
+	RSV() byte
+
+	//WriteFrame transforms a data frame before it is sent. The payload belongs to the caller, replace it rather than changing it.
+	WriteFrame(f *Frame) error
+
+	//ReadFrame transforms a data frame after it was received, before it is put together with the rest of its message.
+	//An error fails the connection, with the code of a CloseError or with CloseProtocolError.
+	ReadFrame(f *Frame) error
+}
+
+/*
+A Frame is a data frame, as seen by a ConnExtension.
+Opcode is TextMessage or BinaryMessage on the first frame of a message, and zero on the frames continuing it.
+Control frames are not passed to extensions.
+*/
+type Frame struct {
+	Fin     bool
+	RSV     byte
+	Opcode  byte
+	Payload []byte
+}
+
+/*
+The extensions agreed on in an opening handshake.
+*/
+type negotiated struct {
+	deflate    *deflateParams
+	extensions []ConnExtension
+	rsv        byte
+	response   []string
+}
+
+/*
+Checks that an extension using the bits in rsv can be added, then adds its response.
+*/
+func (n *negotiated) claim(rsv byte, response string) bool {
+	if rsv&n.rsv != 0 || rsv&^selectRsv != 0 {
+		return false
+	}
+	n.rsv |= rsv
+	n.response = append(n.response, response)
+	return true
+}
+
+/*
+Sets up a new connection with the negotiated extensions.
+*/
+func (n *negotiated) apply(c *Conn, cfg *Compression, client bool) {
+	if n.deflate != nil {
+		c.deflate = newDeflateState(n.deflate, cfg, client)
+	}
+	c.extensions = n.extensions
+	c.rsv = n.rsv
+}
+
+/*
+Returns the Sec-WebSocket-Extensions value a client sends to offer compression and extensions.
+*/
+func offerExtensions(cfg *Compression, extensions []Extension) string {
+	var offers []string
+	if cfg != nil {
+		offers = append(offers, cfg.offer())
+	}
+	for _, ext := range extensions {
+		offer := ext.Name()
+		if params := ext.Offer(); params != "" {
+			offer += "; " + params
+		}
+		offers = append(offers, offer)
+	}
+	return strings.Join(offers, ", ")
+}
+
+/*
+Chooses the extensions to accept from the offers in req, taking the first acceptable offer for each extension.
+Extensions whose RSV bits are already used are declined.
+*/
+func (u *Upgrader) negotiate(req *http.Request) *negotiated {
+	n := new(negotiated)
+	offers, ok := parseExtensions(req.Header.Values("Sec-WebSocket-Extensions"))
+	if !ok {
+		return n
+	}
+
+	accepted := make(map[string]bool)
+	for _, offer := range offers {
+		if accepted[offer.name] {
+			continue
+		}
+		if offer.name == "permessage-deflate" && u.Compression != nil {
+			if p := u.Compression.accept(offer.params); p != nil && n.claim(rsv1, p.String()) {
+				n.deflate = p
+				accepted[offer.name] = true
+			}
+			continue
+		}
+		for _, ext := range u.Extensions {
+			if ext.Name() != offer.name {
+				continue
+			}
+			params, ce, ok := ext.Accept(offer.params)
+			if !ok {
+				continue
+			}
+			response := ext.Name()
+			if params != "" {
+				response += "; " + params
+			}
+			if n.claim(ce.RSV(), response) {
+				n.extensions = append(n.extensions, ce)
+				accepted[offer.name] = true
+			}
+		}
+	}
+	return n
+}
+
+/*
+Checks the extensions a server accepted in h, against those offered.
+Returns the agreed extensions, or the reason the response is invalid.
+*/
+func confirmExtensions(h http.Header, cfg *Compression, extensions []Extension) (*negotiated, string) {
+	n := new(negotiated)
+	exts, ok := parseExtensions(h.Values("Sec-WebSocket-Extensions"))
+	if !ok {
+		return nil, "malformed Sec-WebSocket-Extensions"
+	}
+
+	confirmed := make(map[string]bool)
+	for _, accepted := range exts {
+		if confirmed[accepted.name] {
+			return nil, "server accepted an extension twice"
+		}
+		confirmed[accepted.name] = true
+
+		if accepted.name == "permessage-deflate" && cfg != nil {
+			p, reason := cfg.confirm(accepted.params)
+			if reason != "" {
+				return nil, reason
+			}
+			if !n.claim(rsv1, "") {
+				return nil, "server accepted extensions using the same RSV bits"
+			}
+			n.deflate = p
+			continue
+		}
+
+		var ext Extension
+		for _, offered := range extensions {
+			if offered.Name() == accepted.name {
+				ext = offered
+				break
+			}
+		}
+		if ext == nil {
+			return nil, "server chose an extension that was not offered"
+		}
+		ce, e := ext.Confirm(accepted.params)
+		if e != nil {
+			return nil, e.Error()
+		}
+		if !n.claim(ce.RSV(), "") {
+			return nil, "server accepted extensions using the same RSV bits"
+		}
+		n.extensions = append(n.extensions, ce)
+	}
+	return n, ""
+}
+
+/*
+Passes a data frame read from the connection through the extensions, last negotiated first.
+*/
+func (c *Conn) readExtensions(f *Frame) error {
+	for i := len(c.extensions) - 1; i >= 0; i-- {
+		if e := c.extensions[i].ReadFrame(f); e != nil {
+			var ce *CloseError
+			if errors.As(e, &ce) && validCloseCode(ce.Code) && len(ce.Reason) <= maxCloseReason {
+				return c.fail(ce.Code, ce.Reason)
+			}
+			return c.fail(CloseProtocolError, "extension could not read frame")
+		}
+	}
+	return nil
+}
+
+/*
+Passes a data frame about to be written through the extensions, first negotiated first.
+*/
+func (c *Conn) writeExtensions(f *Frame) error {
+	for _, ext := range c.extensions {
+		if e := ext.WriteFrame(f); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+/*
+An extension in a Sec-WebSocket-Extensions header, with its parameters in order.
+*/
+type extension struct {
+	name   string
+	params []ExtensionParam
+}
+
+/*
+Parses the extensions listed in Sec-WebSocket-Extensions header values.
+Returns false if the header is malformed.
+*/
+func parseExtensions(values []string) ([]extension, bool) {
+	var exts []extension
+	s := strings.Join(values, ",")
+	for {
+		//Empty list elements are allowed
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return exts, true
+		}
+
+		var ext extension
+		if ext.name, s = nextToken(s); ext.name == "" {
+			return nil, false
+		}
+		for {
+			s = strings.TrimLeft(s, " \t")
+			if s == "" || s[0] == ',' {
+				break
+			}
+			if s[0] != ';' {
+				return nil, false
+			}
+
+			var param ExtensionParam
+			if param.Name, s = nextToken(strings.TrimLeft(s[1:], " \t")); param.Name == "" {
+				return nil, false
+			}
+			s = strings.TrimLeft(s, " \t")
+			if s != "" && s[0] == '=' {
+				var ok bool
+				if param.Value, s, ok = nextValue(strings.TrimLeft(s[1:], " \t")); !ok {
+					return nil, false
+				}
+			}
+			ext.params = append(ext.params, param)
+		}
+		exts = append(exts, ext)
+	}
+}
+
+/*
+Splits the token at the start of s from the rest.
+*/
+func nextToken(s string) (string, string) {
+	i := 0
+	for i < len(s) && isTokenChar(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+/*
+Splits the parameter value at the start of s from the rest, unquoting it if it is a quoted string.
+*/
+func nextValue(s string) (string, string, bool) {
+	if s == "" || s[0] != '"' {
+		v, rest := nextToken(s)
+		return v, rest, v != ""
+	}
+
+	var v strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return v.String(), s[i+1:], true
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", s, false
+			}
+		}
+		v.WriteByte(s[i])
+	}
+	return "", s, false
+}
+
+/*
+Reports whether b may appear in a token, as defined by RFC 7230.
+*/
+func isTokenChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", b) >= 0
+}
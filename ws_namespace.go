@@ -5,7 +5,7 @@ A Namespace is a subset of clients connected to the server.
 */
 type Namespace struct {
 	name     string
-	clients  map[int64]*Conn
+	clients  map[string]*Conn
 	children map[string]*Namespace
 }
 
@@ -14,7 +14,7 @@ Creates a new Namespace.
 */
 func NewNamespace(n string) *Namespace {
 	var ns Namespace
-	ns = Namespace{n, make(map[int64]*Conn), make(map[string]*Namespace)}
+	ns = Namespace{n, make(map[string]*Conn), make(map[string]*Namespace)}
 	return &ns
 }
 
@@ -47,16 +47,30 @@ func (n *Namespace) RemoveChild(nc *Namespace) {
 }
 
 /*
-Write a message to all clients in this namespace and all clients of child namespaces.
+Write a message to all clients in this namespace and all clients of child namespaces, concurrently.
+Returns len(b) if every client was written to, otherwise a BroadcastError listing the clients that failed.
 */
 func (n *Namespace) Write(b []byte) (int, error) {
-	for _, client := range n.clients {
-		go client.Write(b)
+	clients := make(map[string]*Conn)
+	n.collect(clients)
+
+	list := make([]*Conn, 0, len(clients))
+	for _, c := range clients {
+		list = append(list, c)
+	}
+	return broadcast(list, b)
+}
+
+/*
+Collects the clients of this namespace and its children, so clients in several of them are only written to once.
+*/
+func (n *Namespace) collect(clients map[string]*Conn) {
+	for id, client := range n.clients {
+		clients[id] = client
 	}
 	for _, child := range n.children {
-		child.Write(b)
+		child.collect(clients)
 	}
-	return 0, nil
 }
 
 /*
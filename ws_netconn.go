@@ -0,0 +1,110 @@
+package ws
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+NetConn returns a net.Conn reading and writing the messages of c, to carry stream protocols over a WebSocket.
+Reads go through the messages one after another, as one stream of bytes. Each write is sent as one message of msgType, TextMessage or BinaryMessage.
+The addresses are those of the underlying connection, and deadlines apply to c.
+Reading carries on after a read deadline passed once it is moved, even partway through a message, unless the message was compressed.
+Read returns io.EOF once the other end has closed the connection normally.
+*/
+func NetConn(c *Conn, msgType int) net.Conn {
+	return &netConn{c: c, msgType: msgType}
+}
+
+/*
+A Conn seen as a net.Conn, as returned by NetConn.
+*/
+type netConn struct {
+	c       *Conn
+	msgType int
+
+	//The message being read, nil between messages
+	readMu sync.Mutex
+	r      io.Reader
+}
+
+func (nc *netConn) Read(b []byte) (int, error) {
+	nc.readMu.Lock()
+	defer nc.readMu.Unlock()
+
+	for {
+		if nc.r == nil {
+			_, r, e := nc.c.NextReader()
+			if e != nil {
+				return 0, netConnError(e)
+			}
+			nc.r = r
+		}
+
+		n, e := nc.r.Read(b)
+		if e == io.EOF {
+			//Empty messages are skipped, rather than reading as the end of the stream
+			nc.r = nil
+			if n == 0 && len(b) > 0 {
+				continue
+			}
+			e = nil
+		}
+		return n, netConnError(e)
+	}
+}
+
+/*
+Returns io.EOF for a connection closed normally by the other end, since that ends the stream.
+*/
+func netConnError(e error) error {
+	var ce *CloseError
+	if errors.As(e, &ce) {
+		switch ce.Code {
+		case CloseNormal, CloseGoingAway, CloseNoStatus:
+			return io.EOF
+		}
+	}
+	return e
+}
+
+func (nc *netConn) Write(b []byte) (int, error) {
+	if nc.msgType != TextMessage && nc.msgType != BinaryMessage {
+		return 0, fmt.Errorf("Invalid message type %d.", nc.msgType)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return nc.c.writeMessage(byte(nc.msgType), b)
+}
+
+func (nc *netConn) Close() error {
+	return nc.c.Close()
+}
+
+func (nc *netConn) LocalAddr() net.Addr {
+	return nc.c.nc.LocalAddr()
+}
+
+func (nc *netConn) RemoteAddr() net.Addr {
+	return nc.c.nc.RemoteAddr()
+}
+
+func (nc *netConn) SetDeadline(t time.Time) error {
+	if e := nc.c.SetReadDeadline(t); e != nil {
+		return e
+	}
+	return nc.c.SetWriteDeadline(t)
+}
+
+func (nc *netConn) SetReadDeadline(t time.Time) error {
+	return nc.c.SetReadDeadline(t)
+}
+
+func (nc *netConn) SetWriteDeadline(t time.Time) error {
+	return nc.c.SetWriteDeadline(t)
+}
@@ -0,0 +1,81 @@
+package ws
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+Returns true if the request has no Origin header, or if the host of its Origin is the same as the request's Host.
+This is the origin policy of a Server without CheckOrigin set.
+*/
+func SameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		//Not a browser, nothing to protect
+		return true
+	}
+	u, e := url.Parse(origin)
+	if e != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Host)
+}
+
+/*
+AllowOrigins creates a CheckOrigin function that accepts requests without an Origin header and requests whose Origin matches one of patterns.
+A pattern is a host such as "example.com" or "example.com:8443", optionally preceded by a scheme as in "https://example.com".
+A pattern without a port matches origins on any port.
+A host beginning with "*." matches any subdomain, so "*.example.com" matches "chat.example.com" but not "example.com" itself.
+The pattern "*" matches any origin.
+*/
+func AllowOrigins(patterns ...string) func(*http.Request) bool {
+	return func(req *http.Request) bool {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, e := url.Parse(origin)
+		if e != nil || u.Host == "" {
+			return false
+		}
+		for _, p := range patterns {
+			if matchOrigin(p, u) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+/*
+Returns true if the origin u matches pattern.
+*/
+func matchOrigin(pattern string, u *url.URL) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	host := pattern
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		if !strings.EqualFold(pattern[:i], u.Scheme) {
+			return false
+		}
+		host = pattern[i+3:]
+	}
+
+	//Without a port, the pattern is compared to the origin's host name only
+	origin := u.Host
+	if _, _, e := net.SplitHostPort(host); e != nil {
+		origin = u.Hostname()
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+
+	if strings.HasPrefix(host, "*.") {
+		suffix := host[1:]
+		return len(origin) > len(suffix) && strings.HasSuffix(strings.ToLower(origin), strings.ToLower(suffix))
+	}
+	return strings.EqualFold(host, origin)
+}
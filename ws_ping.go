@@ -0,0 +1,126 @@
+package ws
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Ping sends a ping frame carrying payload and waits for the matching pong.
+If payload is empty, a unique payload is generated. Payloads are limited to 125 bytes.
+Pongs are only seen while the connection is being read, by Handle or ReadTo on another goroutine.
+Returns the round-trip time, or an error if ctx is done before the pong arrives, even if the ping could not be written yet.
+*/
+func (c *Conn) Ping(ctx context.Context, payload []byte) (time.Duration, error) {
+	if len(payload) == 0 {
+		payload = make([]byte, 8)
+		binary.BigEndian.PutUint64(payload, atomic.AddUint64(&c.pingSeq, 1))
+	}
+	if len(payload) > maxControlPayload {
+		return 0, errors.New("Ping payload is longer than 125 bytes.")
+	}
+
+	//Pings with the same payload share their pong
+	key := string(payload)
+	c.pingMu.Lock()
+	if c.pings == nil {
+		c.pings = make(map[string]chan struct{})
+	}
+	pong, ok := c.pings[key]
+	if !ok {
+		pong = make(chan struct{})
+		c.pings[key] = pong
+	}
+	c.pingMu.Unlock()
+
+	forget := func() {
+		c.pingMu.Lock()
+		if c.pings[key] == pong {
+			delete(c.pings, key)
+		}
+		c.pingMu.Unlock()
+	}
+
+	//The ping waits behind other writes, which may be stuck, so it is written on its own goroutine and bounded by ctx's deadline
+	start := time.Now()
+	deadline, _ := ctx.Deadline()
+	written := make(chan error, 1)
+	go func() {
+		written <- c.writeFrameBy(deadline, msbOn, opPing, payload)
+	}()
+
+	select {
+	case e := <-written:
+		if e != nil {
+			forget()
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			return 0, e
+		}
+	case <-ctx.Done():
+		forget()
+		return 0, ctx.Err()
+	}
+
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		forget()
+		return 0, ctx.Err()
+	case <-c.done:
+		return 0, errors.New("Connection closed while waiting for pong.")
+	}
+}
+
+/*
+Replies to a ping with a pong carrying the same payload.
+*/
+func (c *Conn) pong(payload []byte) {
+	c.writeFrame(msbOn, opPong, payload)
+}
+
+/*
+Wakes the Ping waiting for a pong with payload, if there is one.
+*/
+func (c *Conn) receivePong(payload []byte) {
+	c.pingMu.Lock()
+	defer c.pingMu.Unlock()
+	if pong, ok := c.pings[string(payload)]; ok {
+		close(pong)
+		delete(c.pings, string(payload))
+	}
+}
+
+/*
+Pings the other end every interval until the connection is closed.
+The connection is closed if a pong does not arrive within timeout, or within interval if timeout is zero.
+*/
+func (c *Conn) keepalive(interval, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		_, e := c.Ping(ctx, nil)
+		cancel()
+		if e != nil {
+			//A peer that stopped answering may have stopped reading too, so a close frame could block behind stuck writes
+			c.teardown()
+			return
+		}
+	}
+}
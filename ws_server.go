@@ -2,30 +2,89 @@ package ws
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
+//Bounds the opening handshake of connections accepted from the listener, when the server has no ReadTimeout
+const defaultHandshakeTimeout = 10 * time.Second
+
+/*
+An IDGenerator returns the id of a new connection, given the request that opened it.
+Ids must be unique among the connected clients of a server.
+*/
+type IDGenerator func(req *http.Request) string
+
 /*
 A WebSocket server.
+It accepts connections from its Listener with Serve, or from an http.Server when used as an http.Handler.
 */
 type Server struct {
 	net.Listener
-	Clients  map[int64]*Conn
+	Upgrader
 	Handler  Handler
 	OnAccept func(net.Conn) bool
 	OnOpen   func(*Conn)
 	OnClose  func(*Conn)
 	SLog     *log.Logger
+	handler  func(*Conn, []byte)
+
+	//IDGenerator assigns the ids of accepted connections. If nil, random 128-bit ids in hex are used.
+	IDGenerator IDGenerator
+
+	//Connected clients by id
+	clients   map[string]*Conn
+	clientsMu sync.RWMutex
+
+	//PingInterval, if set, pings every client on this interval to keep its connection alive.
+	//Clients that do not answer within PongTimeout, or within PingInterval if it is zero, are closed.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	//CloseTimeout is how long closing a client waits for it to answer the close frame. Defaults to 5 seconds.
+	CloseTimeout time.Duration
+
+	//ReadTimeout bounds reading the opening handshake, and each message once it started arriving.
+	//WriteTimeout bounds writing the handshake response, and each frame.
+	//IdleTimeout bounds how long a client may go without sending a message.
+	//Zero values mean no timeout, except for the handshake which then gets 10 seconds. Handshakes accepted by ServeHTTP are bounded by the http.Server instead.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	//MaxMessageSize is the largest message in bytes a client may send, larger ones close it with CloseMessageTooBig.
+	//Zero means no limit.
+	MaxMessageSize int64
+}
+
+/*
+NewServer creates a server without a listener, handling messages with handler function.
+Mount it on an http.ServeMux to accept WebSocket connections next to regular handlers.
+*/
+func NewServer(handler func(*Conn, []byte)) *Server {
+	s := newServer(nil)
+	s.handler = handler
+	return s
+}
+
+/*
+Creates a server accepting connections from l.
+*/
+func newServer(l net.Listener) *Server {
+	return &Server{Listener: l, clients: make(map[string]*Conn)}
 }
 
 /*
 Accept accepts a WebSocket connection, replying to the client with an accept response and returns it.
 An error will be returned if the request was invalid or the connection was not accepted.
-TODO: Check request for validity
+Invalid requests are answered with an HTTP error response and a RequestError is returned.
 */
 func (s *Server) Accept() (*Conn, error) {
 	//s.SLog.Println("Accept connection.")
@@ -33,88 +92,274 @@ func (s *Server) Accept() (*Conn, error) {
 	//Accept on the underlying Listener
 	c, e := s.Listener.Accept()
 	if e != nil {
-		s.SLog.Printf("listener couldnt accept: %s\n", e)
+		s.logf("listener couldnt accept: %s\n", e)
 		return nil, e
 	}
+	return s.handshake(c)
+}
 
-	if !s.OnAccept(c) {
+/*
+Reads the opening handshake from a connection accepted on the listener, and replies to it.
+For TLS listeners, this includes the TLS handshake. Both are bounded by ReadTimeout, or defaultHandshakeTimeout without one.
+*/
+func (s *Server) handshake(c net.Conn) (*Conn, error) {
+	if s.OnAccept != nil && !s.OnAccept(c) {
+		c.Close()
 		return nil, fmt.Errorf("Connection not approved: %s\n", c.RemoteAddr())
 	}
 
 	//Get Request
 	//s.SLog.Printf("Reading request from %s\n", c.RemoteAddr())
 
-	req, e := http.ReadRequest(bufio.NewReader(c))
-	//req, e := http.ReadRequest(bufio.NewReader(reader))
+	timeout := s.ReadTimeout
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+	br := bufio.NewReader(c)
+	req, e := http.ReadRequest(br)
 
 	if e != nil {
-		s.SLog.Printf("HTTP WS Request parse error: %s\n", e)
-		return nil, e
+		s.logf("HTTP WS Request parse error: %s\n", e)
+		return nil, s.reject(c, &RequestError{http.StatusBadRequest, nil, "malformed request"})
+	}
+
+	protocol, re := s.check(req)
+	if re != nil {
+		return nil, s.reject(c, re)
 	}
 
-	e = createAcceptResponse(req).Write(c)
+	if s.WriteTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+	}
+	extensions := s.negotiate(req)
+	e = createAcceptResponse(req, protocol, extensions.response).Write(c)
 	if e != nil {
-		s.SLog.Printf("HTTP WS Response parse error: %s\n", e)
+		s.logf("HTTP WS Response parse error: %s\n", e)
+		c.Close()
 		return nil, e
 	}
+	c.SetDeadline(time.Time{})
 
 	//createAcceptResponse(req).Write(os.Stdout)
 
-	wsc := Conn{c, false, time.Now().Unix(), s.Handler, nil, nil}
-	s.Clients[wsc.Id()] = &wsc
-	s.SLog.Printf("Client connected, number of clients is now %v.\n", len(s.Clients))
+	wsc := newConn(c, br, false)
+	wsc.subprotocol = protocol
+	extensions.apply(wsc, s.Compression, false)
+	if e = s.add(wsc, req); e != nil {
+		return nil, e
+	}
+
+	return wsc, nil
+}
+
+/*
+ServeHTTP upgrades the request to a WebSocket connection and handles it until it is closed,
+routing messages to the handler function given to NewServer.
+*/
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c, e := s.Upgrade(w, req)
+	if e != nil {
+		s.logf("Not accepted: %s\n", e)
+		return
+	}
+	if e = s.add(c, req); e != nil {
+		s.logf("Not accepted: %s\n", e)
+		return
+	}
+	s.open(c)
+
+	//The request's goroutine belongs to this connection now
+	c.Handle(s.handler)
+}
+
+/*
+Sends the response for a rejected request and closes the connection.
+Returns the rejection as an error.
+*/
+func (s *Server) reject(c net.Conn, re *RequestError) error {
+	if s.WriteTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+	}
+	re.response().Write(c)
+	c.Close()
+	return re
+}
+
+/*
+Registers an accepted connection with the server, under a new id for the request that opened it.
+The connection is closed if the id is already in use.
+*/
+func (s *Server) add(c *Conn, req *http.Request) error {
+	newID := s.IDGenerator
+	if newID == nil {
+		newID = randomID
+	}
+	id := newID(req)
+
+	s.clientsMu.Lock()
+	if _, taken := s.clients[id]; taken {
+		s.clientsMu.Unlock()
+		c.fail(ClosePolicyViolation, "connection id in use")
+		return fmt.Errorf("Connection id %q is already in use.", id)
+	}
+	c.id = id
+	s.configure(c)
+	s.clients[id] = c
+	n := len(s.clients)
+	s.clientsMu.Unlock()
+	s.logf("Client %s connected, number of clients is now %v.\n", id, n)
+	return nil
+}
+
+/*
+Generates a random 128-bit id in hex.
+*/
+func randomID(*http.Request) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/*
+Removes a closed connection from the server.
+*/
+func (s *Server) remove(c *Conn) {
+	s.clientsMu.Lock()
+	if s.clients[c.Id()] == c {
+		delete(s.clients, c.Id())
+	}
+	n := len(s.clients)
+	s.clientsMu.Unlock()
+	s.logf("Client %s closed, number of clients is now %v.\n", c.Id(), n)
+}
+
+/*
+Count returns the number of connected clients.
+*/
+func (s *Server) Count() int {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+	return len(s.clients)
+}
+
+/*
+Get returns the connected client with the given id.
+*/
+func (s *Server) Get(id string) (*Conn, bool) {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+	c, ok := s.clients[id]
+	return c, ok
+}
+
+/*
+Range calls f for each connected client, stopping if f returns false.
+The clients are those connected when Range was called, f may close them or connect others.
+*/
+func (s *Server) Range(f func(*Conn) bool) {
+	for _, c := range s.snapshot() {
+		if !f(c) {
+			return
+		}
+	}
+}
+
+/*
+Returns the connected clients.
+*/
+func (s *Server) snapshot() []*Conn {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+	clients := make([]*Conn, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
 
-	return &wsc, nil
+/*
+Applies the server's settings to a connection.
+Called before the connection is registered, so broadcasts never see it half configured.
+*/
+func (s *Server) configure(c *Conn) {
+	c.Handler = s.Handler
+	c.OnClose = s.OnClose
+	c.server = s
+	c.closeTimeout = s.CloseTimeout
+	c.readTimeout = s.ReadTimeout
+	c.writeTimeout = s.WriteTimeout
+	c.idleTimeout = s.IdleTimeout
+	c.readLimit = s.MaxMessageSize
+}
+
+/*
+Starts handling an accepted connection.
+*/
+func (s *Server) open(c *Conn) {
+	if s.PingInterval > 0 {
+		go c.keepalive(s.PingInterval, s.PongTimeout)
+	}
+	if s.OnOpen != nil {
+		s.OnOpen(c)
+	}
 }
 
 /*
 Close closes all connections with the server.
 */
 func (s *Server) Close() {
-	s.SLog.Println("Closing all connectons...")
-	for _, client := range s.Clients {
-		client.Close()
+	s.logf("Closing all connectons...\n")
+
+	//Close concurrently, so slow clients don't hold up the rest
+	var wg sync.WaitGroup
+	for _, client := range s.snapshot() {
+		wg.Add(1)
+		go func(c *Conn) {
+			defer wg.Done()
+			c.Close()
+		}(client)
 	}
+	wg.Wait()
 }
 
 /*
 Serve tells the server to start accepting connections.
+Each connection's handshake is read on its own goroutine, so slow clients don't hold up the others.
 */
 func (s *Server) Serve(handler func(*Conn, []byte)) error {
 	for {
-		var c *Conn
-		var e error
-
 		//Accept
-		if c, e = s.Accept(); e != nil {
-			//s.SLog.Println("Error acceptig")
-			s.SLog.Printf("Not accepted: %s\n", e)
-			//return e
+		nc, e := s.Listener.Accept()
+		if e != nil {
+			s.logf("listener couldnt accept: %s\n", e)
+			//Stop once the listener has been closed
+			if errors.Is(e, net.ErrClosed) {
+				return e
+			}
 			continue
 		}
 
-		//s.SLog.Println("Connection accepted")
-		c.Handler = s.Handler
-		c.OnClose = s.OnClose
-		c.server = s
-		if s.OnOpen != nil {
-			s.OnOpen(c)
-		}
-
 		//Handle client concurrently
-		go c.Handle(handler)
+		go func() {
+			c, e := s.handshake(nc)
+			if e != nil {
+				s.logf("Not accepted: %s\n", e)
+				return
+			}
+			s.open(c)
+			c.Handle(handler)
+		}()
 	}
 	//return nil
 }
 
 /*
-Write sends a message to all clients.
+Write sends a message to all clients, concurrently.
+Returns len(message) if every client was written to, otherwise a BroadcastError listing the clients that failed.
 */
 func (s *Server) Write(message []byte) (int, error) {
-	for _, client := range s.Clients {
-		go client.Write(message)
-	}
-	return 0, nil
+	return broadcast(s.snapshot(), message)
 }
 
 /*
@@ -124,3 +369,12 @@ func (s *Server) WriteString(message string) (int, error) {
 	asBytes := []byte(message)
 	return s.Write(asBytes)
 }
+
+/*
+Logs to the server's logger, if it has one.
+*/
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.SLog != nil {
+		s.SLog.Printf(format, v...)
+	}
+}
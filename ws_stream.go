@@ -0,0 +1,323 @@
+package ws
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//Fragment size of streamed messages, when the connection has none set
+const streamFragmentSize = 32 * 1024
+
+//Returned when writing to a message writer after closing it
+var errWriterClosed = errors.New("Message writer is closed.")
+
+/*
+NextReader starts reading the next message, returning its type and a reader for its payload.
+The payload is read from the connection as the reader is read, so messages of any size take constant memory.
+The reader returns io.EOF at the end of the message, and is only valid until the next message is read.
+Whatever is left of a message is skipped when the next one is read.
+*/
+func (c *Conn) NextReader() (int, io.Reader, error) {
+	return c.nextMessage()
+}
+
+/*
+Reads one message, as returned by NextReader.
+Errors fail the connection as the protocol requires, and end the message.
+*/
+type messageStream struct {
+	c       *Conn
+	msg     *messageReader
+	src     io.Reader
+	inflate *inflateReader
+	text    *utf8Validator
+	limited bool
+	left    int64
+	err     error
+}
+
+func (s *messageStream) Read(p []byte) (int, error) {
+	s.c.readMu.Lock()
+	defer s.c.readMu.Unlock()
+	return s.read(p)
+}
+
+/*
+Reads like Read. Called with the connection's readMu held.
+*/
+func (s *messageStream) read(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	n, e := s.src.Read(p)
+	if s.limited {
+		if int64(n) > s.left {
+			n, e = 0, errMessageTooBig
+		}
+		s.left -= int64(n)
+	}
+	if s.text != nil && n > 0 {
+		if _, ve := s.text.Write(p[:n]); ve != nil {
+			n, e = 0, ve
+		}
+	}
+	if e == io.EOF {
+		e = s.finish()
+	}
+
+	//A timeout can be recovered from while the data read so far is all used, the decompressor keeps its errors
+	if e != nil && isTimeout(e) && s.inflate == nil && !s.c.readBroken {
+		return n, e
+	}
+	if e != nil {
+		s.end(e)
+	}
+	return n, s.err
+}
+
+/*
+An io.Reader calling a read function, to read a stream while readMu is already held.
+*/
+type readFunc func([]byte) (int, error)
+
+func (f readFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+/*
+Checks the end of the message. Returns io.EOF if it is complete.
+*/
+func (s *messageStream) finish() error {
+	if s.inflate != nil {
+		//Skip anything following the end of the compressed data, to get to the next message
+		if _, e := io.Copy(io.Discard, s.msg); e != nil {
+			return e
+		}
+	}
+	if s.text != nil && s.text.Close() != nil {
+		return ErrInvalidUTF8
+	}
+	return io.EOF
+}
+
+/*
+Ends the message with e, failing the connection if the message broke the protocol.
+*/
+func (s *messageStream) end(e error) {
+	if s.inflate != nil {
+		s.inflate.Close()
+		s.inflate = nil
+	}
+
+	switch e {
+	case io.EOF:
+	case ErrInvalidUTF8:
+		e = s.c.fail(CloseInvalidPayload, "invalid UTF-8")
+	case errInvalidCompressed:
+		e = s.c.fail(CloseInvalidPayload, "invalid compressed data")
+	case errMessageTooBig:
+		e = s.c.fail(CloseMessageTooBig, "message too big")
+	}
+
+	//The rest of the message is lost
+	if e != io.EOF {
+		s.c.readBroken = true
+	}
+	s.err = e
+}
+
+/*
+NextWriter starts writing a message of the given type, TextMessage or BinaryMessage.
+The message is sent in fragments as it is written, the size set by SetFragmentSize or 32KiB, so messages of any size take constant memory.
+Closing the writer sends the last fragment. No other message can be written until then, though control frames still can.
+A message longer than a fragment is compressed whenever compression is on, shorter ones only if they reach the threshold.
+*/
+func (c *Conn) NextWriter(msgType int) (io.WriteCloser, error) {
+	if msgType != TextMessage && msgType != BinaryMessage {
+		return nil, fmt.Errorf("Invalid message type %d.", msgType)
+	}
+
+	size := c.fragmentSize
+	if size <= 0 {
+		size = streamFragmentSize
+	}
+
+	c.lockMessages()
+	w := &messageWriter{c: c, op: byte(msgType), size: size, buf: make([]byte, 0, size)}
+	if msgType == TextMessage {
+		w.text = new(utf8Validator)
+	}
+	return w, nil
+}
+
+/*
+Writes one message in fragments, as returned by NextWriter. It holds the connection's msgLock until it is closed.
+*/
+type messageWriter struct {
+	c    *Conn
+	op   byte
+	rsv  byte
+	size int
+	text *utf8Validator
+	sent bool
+	err  error
+
+	//Written data waiting for a fragment to fill up, until the message is compressed
+	buf []byte
+
+	//The compressor, once the message is being compressed
+	fw *flate.Writer
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.text != nil {
+		if _, e := w.text.Write(p); e != nil {
+			w.err = e
+			return 0, e
+		}
+	}
+
+	n := len(p)
+	for len(p) > 0 && w.fw == nil {
+		//A full fragment is only sent once more follows it, the last one goes out on Close
+		if len(w.buf) == w.size {
+			if e := w.flush(); e != nil {
+				return 0, e
+			}
+			continue
+		}
+		k := copy(w.buf[len(w.buf):w.size], p)
+		w.buf = w.buf[:len(w.buf)+k]
+		p = p[k:]
+	}
+
+	if w.fw != nil && len(p) > 0 {
+		if _, e := w.fw.Write(p); e != nil {
+			w.err = e
+			return 0, e
+		}
+		if e := w.sendCompressed(); e != nil {
+			return 0, e
+		}
+	}
+	return n, nil
+}
+
+/*
+Sends the full fragment in w.buf, or starts compressing the message with it.
+*/
+func (w *messageWriter) flush() error {
+	d := w.c.deflate
+	if !w.sent && d != nil && d.enabled {
+		w.fw, w.rsv = d.begin(), rsv1
+		if _, e := w.fw.Write(w.buf); e != nil {
+			w.err = e
+			return e
+		}
+		w.buf = w.buf[:0]
+		return w.sendCompressed()
+	}
+
+	e := w.send(false, w.buf)
+	w.buf = w.buf[:0]
+	return e
+}
+
+/*
+Sends whole fragments of the compressed data so far.
+*/
+func (w *messageWriter) sendCompressed() error {
+	wbuf := &w.c.deflate.wbuf
+	for wbuf.Len() > w.size {
+		if e := w.send(false, wbuf.Next(w.size)); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+/*
+Sends b as fragments, the last one ending the message.
+*/
+func (w *messageWriter) sendAll(b []byte) error {
+	for {
+		chunk := b
+		if len(chunk) > w.size {
+			chunk = chunk[:w.size]
+		}
+		b = b[len(chunk):]
+		if e := w.send(len(b) == 0, chunk); e != nil {
+			return e
+		}
+		if len(b) == 0 {
+			return nil
+		}
+	}
+}
+
+/*
+Sends a fragment of the message.
+*/
+func (w *messageWriter) send(fin bool, b []byte) error {
+	if e := w.c.writeFragment(fin, w.rsv, w.op, b); e != nil {
+		w.err = e
+		return e
+	}
+	w.sent, w.op, w.rsv = true, opContinue, 0
+	return nil
+}
+
+/*
+Close sends the last fragment of the message, and lets the next message be written.
+*/
+func (w *messageWriter) Close() error {
+	if w.err == errWriterClosed {
+		return nil
+	}
+	e := w.finish()
+	w.err = errWriterClosed
+	w.c.unlockMessages()
+
+	//Invalid text can't be taken back once part of it was sent
+	if e == ErrInvalidUTF8 && w.sent {
+		w.c.fail(CloseInvalidPayload, "invalid UTF-8")
+	}
+	return e
+}
+
+/*
+Sends what is left of the message.
+*/
+func (w *messageWriter) finish() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.text != nil && w.text.Close() != nil {
+		return ErrInvalidUTF8
+	}
+
+	d := w.c.deflate
+	switch {
+	case w.fw != nil:
+		rest, e := d.end(w.fw)
+		if e != nil {
+			return e
+		}
+		return w.sendAll(rest)
+	case !w.sent && d != nil && d.compresses(len(w.buf)):
+		payload, e := d.compress(w.buf)
+		if e != nil {
+			return e
+		}
+		w.rsv = rsv1
+		return w.sendAll(payload)
+	default:
+		return w.send(true, w.buf)
+	}
+}
@@ -1,9 +1,26 @@
 package ws
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	//"os"
-	"bytes"
 	"testing"
 	"time"
 )
@@ -64,6 +81,37 @@ func TestMaskIO(t *testing.T) {
 		t.Errorf("Masking/Unmasking failure.")
 	}
 
+	//Word-at-a-time masking matches masking byte by byte, from any mask position and over chunks
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	for _, size := range []int{0, 1, 7, 8, 9, 100, maxMaskChunk + 13} {
+		for pos := 0; pos < 4; pos++ {
+			b := make([]byte, size)
+			for i := range b {
+				b[i] = byte(i)
+			}
+			if next := maskBytes(mask, pos, b); next != (pos+size)%4 {
+				t.Errorf("Mask position after %d bytes from %d is %d", size, pos, next)
+			}
+			for i := range b {
+				if b[i] != byte(i)^mask[(pos+i)%4] {
+					t.Fatalf("Masking %d bytes from position %d is wrong at %d", size, pos, i)
+				}
+			}
+		}
+
+		m := make([]byte, size)
+		rand.Read(m)
+		df := NewFrame(m)
+		df.GenerateMask()
+		var encoded, decoded bytes.Buffer
+		if err := df.Encode(m, &encoded); err != nil {
+			t.Fatal(err)
+		}
+		if err := df.DecodeTo(&encoded, &decoded); err != nil || !bytes.Equal(decoded.Bytes(), m) {
+			t.Errorf("Masking/Unmasking failure for %d bytes.", size)
+		}
+	}
+
 }
 
 func TestClientServer(t *testing.T) {
@@ -73,8 +121,9 @@ func TestClientServer(t *testing.T) {
 	var server *Server
 	server, err = Listen(":7331")
 	if err != nil {
-		t.Errorf("Error starting server.", err)
+		t.Fatalf("Error starting server: %s", err)
 	}
+	defer server.Listener.Close()
 
 	go server.Serve(func(c *Conn, m []byte) {
 		fmt.Printf("Server got message: %s\n", string(m))
@@ -89,7 +138,7 @@ func TestClientServer(t *testing.T) {
 	var conn *Conn
 	conn, err = Dial(":7331")
 	if err != nil {
-		t.Errorf("Error dialing server.", err)
+		t.Errorf("Error dialing server: %s", err)
 	}
 
 	//Add a callback on a goroutine
@@ -104,7 +153,7 @@ func TestClientServer(t *testing.T) {
 	//Write to the connection
 	_, err = conn.Write([]byte("Hello, server."))
 	if err != nil {
-		t.Errorf("Error writing to server connection.", err)
+		t.Errorf("Error writing to server connection: %s", err)
 	}
 
 	/*
@@ -121,3 +170,1683 @@ func TestClientServer(t *testing.T) {
 	server.Close()
 	conn.Close()
 }
+
+/*
+Starts a listener that reads one websocket request and replies with respond.
+Returns the address of the listener and a channel receiving the request.
+*/
+func testRawServer(t *testing.T, respond func(net.Conn, *http.Request)) (string, <-chan *http.Request) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	requests := make(chan *http.Request, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+		requests <- req
+		respond(c, req)
+	}()
+	return l.Addr().String(), requests
+}
+
+func TestDialURL(t *testing.T) {
+
+	host, requests := testRawServer(t, func(c net.Conn, req *http.Request) {
+		createAcceptResponse(req, "", nil).Write(c)
+	})
+
+	conn, err := DialURL(context.Background(), "ws://"+host+"/v2/stream?token=x")
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	defer conn.Base().Close()
+
+	req := <-requests
+	if req.Host != host {
+		t.Errorf("Host header is %q, expected %q", req.Host, host)
+	}
+	if req.RequestURI != "/v2/stream?token=x" {
+		t.Errorf("Request target is %q", req.RequestURI)
+	}
+	if req.URL.Query().Get("token") != "x" {
+		t.Errorf("Query was not sent: %q", req.URL.RawQuery)
+	}
+
+	_, err = DialURL(context.Background(), "http://"+host+"/")
+	var se *UnsupportedSchemeError
+	if !errors.As(err, &se) || se.Scheme != "http" {
+		t.Errorf("Expected an UnsupportedSchemeError, got %v", err)
+	}
+}
+
+func TestDialRejected(t *testing.T) {
+
+	host, _ := testRawServer(t, func(c net.Conn, req *http.Request) {
+		c.Write([]byte("HTTP/1.1 404 Not Found\r\nContent-Length: 9\r\nX-Test: yes\r\n\r\nno socket"))
+	})
+
+	_, err := Dial(host)
+	var he *HandshakeError
+	if !errors.As(err, &he) {
+		t.Fatalf("Expected a HandshakeError, got %v", err)
+	}
+	if he.StatusCode != http.StatusNotFound || string(he.Body) != "no socket" || he.Header.Get("X-Test") != "yes" {
+		t.Errorf("HandshakeError does not describe the response: %d %q %v", he.StatusCode, he.Body, he.Header)
+	}
+
+	//A response to a different key must not be accepted
+	host, _ = testRawServer(t, func(c net.Conn, req *http.Request) {
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		createAcceptResponse(req, "", nil).Write(c)
+	})
+
+	_, err = Dial(host)
+	if !errors.As(err, &he) || he.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("Expected a HandshakeError for a bad accept key, got %v", err)
+	}
+}
+
+/*
+Creates a self-signed certificate for 127.0.0.1 and a pool that trusts it.
+*/
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ws test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Error parsing certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestDialTLS(t *testing.T) {
+
+	cert, pool := testCertificate(t)
+	server, err := ListenTLS("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Error starting server: %s", err)
+	}
+	defer server.Listener.Close()
+
+	go server.Serve(func(c *Conn, m []byte) {
+		c.Write(append([]byte("echo: "), m...))
+	})
+
+	//The certificate is not trusted by default
+	url := "wss://" + server.Addr().String() + "/ws"
+	if _, err = DialURL(context.Background(), url); err == nil {
+		t.Errorf("Dialed a server with an untrusted certificate.")
+	}
+
+	d := Dialer{TLSConfig: &tls.Config{RootCAs: pool}}
+	conn, err := d.DialURL(context.Background(), url)
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	defer conn.Base().Close()
+
+	if _, ok := conn.Base().(*tls.Conn); !ok {
+		t.Errorf("Connection is not a TLS connection: %T", conn.Base())
+	}
+
+	if _, err = conn.Write([]byte("secret")); err != nil {
+		t.Fatalf("Error writing to server: %s", err)
+	}
+	var buffer bytes.Buffer
+	if err = conn.ReadTo(&buffer); err != nil {
+		t.Fatalf("Error reading from server: %s", err)
+	}
+	if buffer.String() != "echo: secret" {
+		t.Errorf("Unexpected reply: %q", buffer.String())
+	}
+}
+
+func TestSubprotocol(t *testing.T) {
+
+	server, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting server: %s", err)
+	}
+	defer server.Listener.Close()
+	server.Subprotocols = []string{"chat.v1", "chat.v2"}
+	go server.Serve(nil)
+
+	//The client's preference wins among the protocols both support
+	d := Dialer{Subprotocols: []string{"chat.v3", "chat.v2", "chat.v1"}}
+	conn, err := d.DialURL(context.Background(), "ws://"+server.Addr().String()+"/")
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	conn.Base().Close()
+	if conn.Subprotocol() != "chat.v2" {
+		t.Errorf("Negotiated %q, expected chat.v2", conn.Subprotocol())
+	}
+
+	//No protocol in common
+	conn, err = DialProtocol(server.Addr().String(), "other")
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	conn.Base().Close()
+	if conn.Subprotocol() != "" {
+		t.Errorf("Negotiated %q, expected none", conn.Subprotocol())
+	}
+
+	//A server choosing a protocol that was not offered is rejected
+	host, _ := testRawServer(t, func(c net.Conn, req *http.Request) {
+		createAcceptResponse(req, "chat.v9", nil).Write(c)
+	})
+	var he *HandshakeError
+	if _, err = DialProtocol(host, "chat.v1, chat.v2"); !errors.As(err, &he) {
+		t.Errorf("Expected a HandshakeError, got %v", err)
+	}
+}
+
+func TestServeSlowHandshake(t *testing.T) {
+
+	server, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting server: %s", err)
+	}
+	defer server.Listener.Close()
+	server.ReadTimeout = 200 * time.Millisecond
+	go server.Serve(nil)
+
+	//A client that never sends its handshake doesn't hold up the next one
+	idle, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	conn, err := Dial(server.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	conn.Base().Close()
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Handshake waited %s behind an idle client", elapsed)
+	}
+
+	//It is dropped after the read timeout
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = io.ReadAll(idle); err != nil {
+		t.Errorf("Idle client was not closed: %v", err)
+	}
+}
+
+func TestServerRejectsInvalidRequests(t *testing.T) {
+
+	server, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting server: %s", err)
+	}
+	defer server.Listener.Close()
+	go server.Serve(nil)
+
+	const valid = "Host: localhost\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+	tests := []struct {
+		request string
+		status  int
+	}{
+		{"GET /ws HTTP/1.1\r\n" + valid + "Sec-WebSocket-Version: 13\r\n\r\n", http.StatusSwitchingProtocols},
+		{"POST /ws HTTP/1.1\r\n" + valid + "Sec-WebSocket-Version: 13\r\nContent-Length: 0\r\n\r\n", http.StatusMethodNotAllowed},
+		{"GET /ws HTTP/1.0\r\n" + valid + "Sec-WebSocket-Version: 13\r\n\r\n", http.StatusHTTPVersionNotSupported},
+		{"GET /ws HTTP/1.1\r\n" + valid + "Sec-WebSocket-Version: 8\r\n\r\n", http.StatusUpgradeRequired},
+		{"GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n\r\n", http.StatusBadRequest},
+		{"GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: c2hvcnQ=\r\nSec-WebSocket-Version: 13\r\n\r\n", http.StatusBadRequest},
+		{"GET /ws HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", http.StatusBadRequest},
+		{"GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", http.StatusBadRequest},
+		{"GET /ws HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", http.StatusBadRequest},
+	}
+
+	for i, test := range tests {
+		c, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			t.Fatalf("Error dialing server: %s", err)
+		}
+		c.Write([]byte(test.request))
+		res, err := http.ReadResponse(bufio.NewReader(c), nil)
+		c.Close()
+		if err != nil {
+			t.Errorf("%d: Error reading response: %s", i, err)
+			continue
+		}
+		if res.StatusCode != test.status {
+			t.Errorf("%d: Got status %d, expected %d", i, res.StatusCode, test.status)
+		}
+		if test.status == http.StatusUpgradeRequired && res.Header.Get("Sec-WebSocket-Version") != "13" {
+			t.Errorf("%d: Missing Sec-WebSocket-Version in 426 response", i)
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+
+	request := func(host, origin string) *http.Request {
+		req := &http.Request{Host: host, Header: make(http.Header)}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		return req
+	}
+
+	if !SameOrigin(request("chat.local:1337", "")) {
+		t.Errorf("Rejected a request without an Origin.")
+	}
+	if !SameOrigin(request("chat.local:1337", "http://Chat.local:1337")) {
+		t.Errorf("Rejected a same-host origin.")
+	}
+	if SameOrigin(request("chat.local:1337", "http://evil.example")) {
+		t.Errorf("Accepted a cross-origin request.")
+	}
+
+	allow := AllowOrigins("https://example.com", "*.example.org", "example.net:8443")
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"https://example.com", true},
+		{"http://example.com", false},
+		{"https://example.com:443", true},
+		{"https://example.com:8443", true},
+		{"https://chat.example.org", true},
+		{"https://chat.example.org:8443", true},
+		{"https://example.net:8443", true},
+		{"https://example.net", false},
+		{"https://example.net:9443", false},
+		{"http://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://evilexample.org", false},
+		{"null", false},
+	}
+	for _, test := range tests {
+		if allow(request("ws.local", test.origin)) != test.ok {
+			t.Errorf("AllowOrigins for %q returned %v", test.origin, !test.ok)
+		}
+	}
+
+	//Rejected browsers get a 403 from the server
+	server, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting server: %s", err)
+	}
+	defer server.Listener.Close()
+	go server.Serve(nil)
+
+	c, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET /ws HTTP/1.1\r\nHost: ws.local\r\nOrigin: http://evil.example\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("Error reading response: %s", err)
+	}
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Got status %d, expected 403", res.StatusCode)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+
+	server := NewServer(func(c *Conn, m []byte) {
+		c.Write(append([]byte("echo: "), m...))
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/ws", server)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("index"))
+	})
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	//Regular handlers still work on the same port
+	res, err := http.Get(hs.URL + "/")
+	if err != nil {
+		t.Fatalf("Error getting index: %s", err)
+	}
+	res.Body.Close()
+
+	conn, err := Dial(hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	defer conn.Base().Close()
+
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Error writing to server: %s", err)
+	}
+	var buffer bytes.Buffer
+	if err = conn.ReadTo(&buffer); err != nil {
+		t.Fatalf("Error reading from server: %s", err)
+	}
+	if buffer.String() != "echo: hello" {
+		t.Errorf("Unexpected reply: %q", buffer.String())
+	}
+
+	//Plain HTTP requests to the socket are rejected
+	res, err = http.Get(hs.URL + "/ws")
+	if err != nil {
+		t.Fatalf("Error getting socket: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Got status %d, expected 400", res.StatusCode)
+	}
+}
+
+func TestFragmentedRead(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := newConn(client, nil, true)
+
+	//A text message in three fragments, with a ping between them
+	go server.Write([]byte{
+		opText, 3, 'H', 'e', 'l',
+		msbOn | opPing, 2, 'h', 'i',
+		opContinue, 1, 'l',
+		msbOn | opContinue, 1, 'o',
+	})
+
+	//The ping is answered while the message is being read
+	pong := make(chan *DataFrame, 1)
+	go func() {
+		var f DataFrame
+		f.ReadFrom(server)
+		io.CopyN(io.Discard, server, int64(f.length))
+		pong <- &f
+	}()
+
+	var buffer bytes.Buffer
+	if err := conn.ReadTo(&buffer); err != nil {
+		t.Fatalf("Error reading fragmented message: %s", err)
+	}
+	if buffer.String() != "Hello" {
+		t.Errorf("Reassembled %q, expected Hello", buffer.String())
+	}
+	if f := <-pong; f.op != opPong || f.length != 2 {
+		t.Errorf("Ping was not answered with a pong: %d", f.op)
+	}
+
+	//A continuation frame can't start a message, the connection is failed with a protocol error
+	go func() {
+		server.Write([]byte{msbOn | opContinue, 1, 'x'})
+		io.Copy(io.Discard, server)
+	}()
+	var ce *CloseError
+	if err := conn.ReadTo(&buffer); !errors.As(err, &ce) || ce.Code != CloseProtocolError {
+		t.Errorf("Accepted a continuation frame without a message: %v", err)
+	}
+}
+
+func TestFragmentedWrite(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := newConn(server, nil, false)
+	conn.SetFragmentSize(4)
+
+	go conn.Write([]byte("Hello, world"))
+
+	//Expect three frames, opened by a text frame and only the last one final
+	r := bufio.NewReader(client)
+	var message []byte
+	for i, op := range []byte{opText, opContinue, opContinue} {
+		var f DataFrame
+		if _, err := f.ReadFrom(r); err != nil {
+			t.Fatalf("Error reading frame %d: %s", i, err)
+		}
+		if f.op != op {
+			t.Errorf("Frame %d has opcode %d, expected %d", i, f.op, op)
+		}
+		if (f.fin == msbOn) != (i == 2) {
+			t.Errorf("Frame %d has the wrong FIN bit", i)
+		}
+		payload := make([]byte, f.length)
+		io.ReadFull(r, payload)
+		message = append(message, payload...)
+	}
+	if string(message) != "Hello, world" {
+		t.Errorf("Fragments contain %q", message)
+	}
+}
+
+func TestPing(t *testing.T) {
+
+	server := NewServer(nil)
+	hs := httptest.NewServer(server)
+	defer hs.Close()
+
+	conn, err := Dial(hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	defer conn.Base().Close()
+	go conn.Handle(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rtt, err := conn.Ping(ctx, []byte("are you there?"))
+	if err != nil {
+		t.Fatalf("Error waiting for pong: %s", err)
+	}
+	if rtt <= 0 {
+		t.Errorf("Round-trip time is %s", rtt)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+
+	server := NewServer(nil)
+	server.PingInterval = 20 * time.Millisecond
+	hs := httptest.NewServer(server)
+	defer hs.Close()
+
+	//A client that never reads never answers pings
+	conn, err := Dial(hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	defer conn.Base().Close()
+
+	conn.Base().SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = io.Copy(io.Discard, conn.Base()); err != nil {
+		t.Errorf("Unresponsive client was not closed: %s", err)
+	}
+
+	//Nor a peer that stopped reading, while another write is stuck
+	local, remote := net.Pipe()
+	defer remote.Close()
+	stuck := newConn(local, nil, false)
+	go stuck.WriteMessage(BinaryMessage, []byte("never read"))
+	go stuck.keepalive(20*time.Millisecond, 0)
+	select {
+	case <-stuck.done:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Peer that stopped reading was not closed")
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+
+	var upgrader Upgrader
+	closed := make(chan error, 1)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		closed <- c.Handle(nil)
+	}))
+	defer hs.Close()
+
+	//The server sees the status sent by the client, and echoes it
+	conn, err := Dial(hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	echo := make(chan error, 1)
+	go func() { echo <- conn.Handle(nil) }()
+
+	if err = conn.CloseWithCode(4000, "bye"); err != nil {
+		t.Errorf("Error closing connection: %s", err)
+	}
+	var ce *CloseError
+	if err = <-closed; !errors.As(err, &ce) || ce.Code != 4000 || ce.Reason != "bye" {
+		t.Errorf("Server got %v, expected close code 4000", err)
+	}
+	if err = <-echo; !errors.As(err, &ce) || ce.Code != 4000 {
+		t.Errorf("Client got %v, expected the close frame to be echoed", err)
+	}
+
+	//Without another reader, Close reads the answer itself rather than waiting out the timeout
+	conn, err = Dial(hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	conn.WriteString("unread")
+	start := time.Now()
+	if err = conn.Close(); err != nil {
+		t.Errorf("Error closing connection: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close waited %s for the answer", elapsed)
+	}
+	if err = <-closed; !errors.As(err, &ce) || ce.Code != CloseNormal {
+		t.Errorf("Server got %v, expected close code 1000", err)
+	}
+	if _, _, err = conn.ReadMessage(); !errors.As(err, &ce) || ce.Code != CloseNormal {
+		t.Errorf("Reading after close returned %v, expected close code 1000", err)
+	}
+
+	//Losing the connection without a close frame is abnormal
+	conn, err = Dial(hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	conn.Base().Close()
+	if err = <-closed; !errors.As(err, &ce) || ce.Code != CloseAbnormal {
+		t.Errorf("Server got %v, expected close code 1006", err)
+	}
+
+	if err = conn.CloseWithCode(CloseAbnormal, ""); err == nil {
+		t.Errorf("Sent a close frame with code 1006.")
+	}
+}
+
+func TestCloseStuckWrites(t *testing.T) {
+
+	//Close gives up on a peer that stopped reading after the close timeout
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := newConn(local, nil, false)
+	conn.SetCloseTimeout(100 * time.Millisecond)
+	go conn.WriteMessage(BinaryMessage, []byte("never read"))
+	time.Sleep(10 * time.Millisecond)
+	closed := make(chan error, 1)
+	go func() { closed <- conn.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Close blocked behind a stuck write")
+	}
+
+	//So does failing the connection, and the callback may close it again
+	local, remote = net.Pipe()
+	defer remote.Close()
+	conn = newConn(local, nil, false)
+	conn.SetCloseTimeout(100 * time.Millisecond)
+	called := make(chan struct{})
+	conn.OnClose = func(c *Conn) {
+		c.Close()
+		close(called)
+	}
+	go conn.WriteMessage(BinaryMessage, []byte("never read"))
+	time.Sleep(10 * time.Millisecond)
+	handled := make(chan error, 1)
+	go func() { handled <- conn.Handle(nil) }()
+	go remote.Write([]byte{msbOn | RSV3 | opBinary, msbOn, 0, 0, 0, 0})
+	var ce *CloseError
+	select {
+	case err := <-handled:
+		if !errors.As(err, &ce) || ce.Code != CloseProtocolError {
+			t.Errorf("Expected close code 1002, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Handle blocked behind a stuck write")
+	}
+	select {
+	case <-called:
+	case <-time.After(2 * time.Second):
+		t.Errorf("OnClose did not return")
+	}
+}
+
+func TestMessageTypes(t *testing.T) {
+
+	server := NewServer(nil)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := server.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		//Echo each message with its type
+		c.HandleMessage(func(c *Conn, msgType int, msg []byte) {
+			c.WriteMessage(msgType, msg)
+		})
+	}))
+	defer hs.Close()
+
+	conn, err := Dial(hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	defer conn.Base().Close()
+
+	for _, msgType := range []int{BinaryMessage, TextMessage} {
+		if err = conn.WriteMessage(msgType, []byte{0, 1, 2}); err != nil {
+			t.Fatalf("Error writing message: %s", err)
+		}
+		got, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Error reading message: %s", err)
+		}
+		if got != msgType || !bytes.Equal(msg, []byte{0, 1, 2}) {
+			t.Errorf("Got message %v of type %d, expected type %d", msg, got, msgType)
+		}
+	}
+
+	if err = conn.WriteMessage(opPing, nil); err == nil {
+		t.Errorf("Wrote a message with a control opcode.")
+	}
+}
+
+func TestUTF8Validation(t *testing.T) {
+
+	//Split valid text at every position, and into single bytes
+	text := []byte("héllo, 世界 🌍")
+	for i := 0; i <= len(text); i++ {
+		var v utf8Validator
+		_, err1 := v.Write(text[:i])
+		_, err2 := v.Write(text[i:])
+		if err1 != nil || err2 != nil || v.Close() != nil {
+			t.Errorf("Valid text split at %d was rejected", i)
+		}
+	}
+	var v utf8Validator
+	for i := range text {
+		if _, err := v.Write(text[i : i+1]); err != nil {
+			t.Fatalf("Valid text written byte by byte was rejected at %d", i)
+		}
+	}
+	if v.Close() != nil {
+		t.Errorf("Valid text written byte by byte was rejected at the end")
+	}
+
+	for _, invalid := range [][]byte{{0xff}, {0xc0, 0xaf}, {0xed, 0xa0, 0x80}, {'a', 0xe4, 0xb8}} {
+		var v utf8Validator
+		_, err := v.Write(invalid)
+		if err == nil && v.Close() == nil {
+			t.Errorf("Accepted invalid text %v", invalid)
+		}
+	}
+
+	//Invalid text is not sent
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if _, err := newConn(client, nil, true).WriteString("\xff"); err != ErrInvalidUTF8 {
+		t.Errorf("Wrote invalid text: %v", err)
+	}
+
+	//Invalid text received across fragments fails the connection with 1007
+	conn := newConn(client, nil, true)
+	go func() {
+		server.Write([]byte{opText, 2, 'a', 0xe4, msbOn | opContinue, 1, 'x'})
+		io.Copy(io.Discard, server)
+	}()
+	var ce *CloseError
+	if err := conn.ReadTo(io.Discard); !errors.As(err, &ce) || ce.Code != CloseInvalidPayload {
+		t.Errorf("Expected close code 1007, got %v", err)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+
+	const writers, messages = 16, 50
+	var upgrader Upgrader
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		c.SetFragmentSize(7)
+		go c.Handle(nil)
+
+		//Many goroutines write fragmented messages at once, while pings are answered
+		for i := 0; i < writers; i++ {
+			go func(i int) {
+				for j := 0; j < messages; j++ {
+					c.WriteMessage(BinaryMessage, bytes.Repeat([]byte{byte(i)}, 10+j))
+				}
+			}(i)
+		}
+	}))
+	defer hs.Close()
+
+	conn, err := Dial(hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	defer conn.Base().Close()
+	conn.Base().SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	go func() {
+		for i := 0; i < messages; i++ {
+			conn.writeFrame(msbOn, opPing, nil)
+		}
+	}()
+
+	for n := 0; n < writers*messages; n++ {
+		msgType, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Error reading message %d: %s", n, err)
+		}
+		if msgType != BinaryMessage || len(msg) < 10 || !bytes.Equal(msg, bytes.Repeat(msg[:1], len(msg))) {
+			t.Fatalf("Message %d is corrupted: %v", n, msg)
+		}
+	}
+}
+
+func TestClientRegistry(t *testing.T) {
+
+	server := NewServer(nil)
+	hs := httptest.NewServer(server)
+	defer hs.Close()
+
+	//Clients come and go while the server broadcasts and walks its clients
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			server.WriteString("broadcast")
+			server.Range(func(c *Conn) bool {
+				if _, ok := server.Get(c.Id()); !ok && server.Count() < 0 {
+					t.Errorf("Impossible client count")
+				}
+				return true
+			})
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := Dial(hs.Listener.Addr().String())
+			if err != nil {
+				t.Errorf("Error dialing server: %s", err)
+				return
+			}
+			go conn.Handle(nil)
+			conn.Close()
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	for i := 0; server.Count() > 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := server.Count(); n != 0 {
+		t.Errorf("%d clients are still registered after closing", n)
+	}
+}
+
+func TestConnectionIDs(t *testing.T) {
+
+	server := NewServer(nil)
+	hs := httptest.NewServer(server)
+	defer hs.Close()
+	host := hs.Listener.Addr().String()
+
+	//Clients connecting at once get different ids
+	ids := make(chan string, 2)
+	server.OnOpen = func(c *Conn) { ids <- c.Id() }
+	for i := 0; i < 2; i++ {
+		conn, err := Dial(host)
+		if err != nil {
+			t.Fatalf("Error dialing server: %s", err)
+		}
+		defer conn.Base().Close()
+	}
+	first, second := <-ids, <-ids
+	if first == second || len(first) != 32 {
+		t.Errorf("Got ids %q and %q", first, second)
+	}
+	if _, ok := server.Get(first); !ok {
+		t.Errorf("Client %q is not registered", first)
+	}
+
+	//Ids can come from the request, but must stay unique
+	server.IDGenerator = func(req *http.Request) string {
+		return req.URL.Query().Get("session")
+	}
+	conn, err := DialURL(context.Background(), "ws://"+host+"/?session=abc")
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	defer conn.Base().Close()
+	if id := <-ids; id != "abc" {
+		t.Errorf("Got id %q, expected abc", id)
+	}
+
+	conn, err = DialURL(context.Background(), "ws://"+host+"/?session=abc")
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	var ce *CloseError
+	if _, _, err = conn.ReadMessage(); !errors.As(err, &ce) || ce.Code != ClosePolicyViolation {
+		t.Errorf("Duplicate id was not rejected: %v", err)
+	}
+}
+
+func TestWriteCounts(t *testing.T) {
+
+	server := NewServer(nil)
+	ids := make(chan string, 2)
+	server.OnOpen = func(c *Conn) { ids <- c.Id() }
+	hs := httptest.NewServer(server)
+	defer hs.Close()
+
+	conn, err := Dial(hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	go conn.Handle(nil)
+	defer conn.Base().Close()
+	<-ids
+
+	if n, err := fmt.Fprintf(conn, "%d apples", 12); n != 9 || err != nil {
+		t.Errorf("Fprintf wrote %d bytes: %v", n, err)
+	}
+	if n, err := server.WriteString("hello"); n != 5 || err != nil {
+		t.Errorf("Broadcast wrote %d bytes: %v", n, err)
+	}
+
+	//A client that can't be written to is named in the error
+	broken, err := Dial(hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	brokenID := <-ids
+	defer broken.Base().Close()
+	c, _ := server.Get(brokenID)
+	c.Base().SetWriteDeadline(time.Unix(1, 0))
+
+	n, err := server.WriteString("hello")
+	var be *BroadcastError
+	if !errors.As(err, &be) || be.Errors[brokenID] == nil || len(be.Errors) != 1 {
+		t.Errorf("Expected a BroadcastError for %s, got %v", brokenID, err)
+	}
+	if n != 0 {
+		t.Errorf("Broadcast reported %d bytes with a failed client", n)
+	}
+}
+
+func TestReadMessageContext(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := newConn(client, nil, true)
+
+	//Giving up before a message arrives leaves the connection usable
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := conn.ReadMessageContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the deadline to be exceeded, got %v", err)
+	}
+
+	go server.Write([]byte{msbOn | opText, 2, 'h', 'i'})
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "hi" {
+		t.Fatalf("Connection is not usable after an idle cancel: %q %v", msg, err)
+	}
+
+	//Giving up halfway through a message closes the connection
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		server.Write([]byte{msbOn | opText, 5, 'h', 'e'})
+		cancel()
+	}()
+	if _, _, err := conn.ReadMessageContext(ctx); err != context.Canceled {
+		t.Fatalf("Expected the read to be canceled, got %v", err)
+	}
+	select {
+	case <-conn.done:
+	default:
+		t.Errorf("Connection was not closed after an interrupted message")
+	}
+}
+
+func TestWriteMessageContext(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	writer := newConn(client, nil, true)
+	reader := newConn(server, nil, false)
+
+	//A context that is already done writes nothing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := writer.WriteMessageContext(ctx, TextMessage, []byte("late")); err != context.Canceled {
+		t.Errorf("Expected the write to be canceled, got %v", err)
+	}
+
+	//Giving up behind another writer leaves its message whole
+	msg := bytes.Repeat([]byte("x"), 1000)
+	written := make(chan error, 1)
+	go func() { written <- writer.WriteMessage(BinaryMessage, msg) }()
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := writer.WriteMessageContext(ctx, TextMessage, []byte("queued")); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to be exceeded, got %v", err)
+	}
+	if _, got, err := reader.ReadMessage(); err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("Message written before the canceled one was cut off: %v", err)
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("Message written before the canceled one failed: %v", err)
+	}
+
+	//Giving up halfway through a message closes the connection
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		io.ReadFull(server, make([]byte, 10))
+		cancel()
+	}()
+	if err := writer.WriteMessageContext(ctx, BinaryMessage, msg); err != context.Canceled {
+		t.Fatalf("Expected the write to be canceled, got %v", err)
+	}
+	select {
+	case <-writer.done:
+	default:
+		t.Errorf("Connection was not closed after an interrupted message")
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+
+	server := NewServer(nil)
+	server.IdleTimeout = 50 * time.Millisecond
+	hs := httptest.NewServer(server)
+	defer hs.Close()
+
+	conn, err := Dial(hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	defer conn.Base().Close()
+
+	//An active client is not closed
+	for i := 0; i < 3; i++ {
+		time.Sleep(25 * time.Millisecond)
+		conn.WriteString("still here")
+	}
+
+	//An idle one is
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var ce *CloseError
+	if _, _, err = conn.ReadMessage(); !errors.As(err, &ce) || ce.Code != CloseGoingAway {
+		t.Errorf("Expected the idle client to be closed with 1001, got %v", err)
+	}
+}
+
+func TestReadLimits(t *testing.T) {
+
+	//Each case fails the connection with the expected code, before reading the payload
+	tests := []struct {
+		name  string
+		limit int64
+		data  []byte
+		code  int
+	}{
+		{"message over the limit", 4, []byte{msbOn | opText, 5, 'h', 'e', 'l', 'l', 'o'}, CloseMessageTooBig},
+		{"fragments over the limit", 4, []byte{opText, 3, 'h', 'e', 'l', msbOn | opContinue, 2, 'l', 'o'}, CloseMessageTooBig},
+		{"huge length", 1 << 20, []byte{msbOn | opBinary, sigUint64, 0, 0, 0x10, 0, 0, 0, 0, 0}, CloseMessageTooBig},
+		{"length with the top bit set", 0, []byte{msbOn | opBinary, sigUint64, 0x80, 0, 0, 0, 0, 0, 0, 0}, CloseProtocolError},
+		{"long control frame", 0, []byte{msbOn | opPing, sigUint16, 0, 126}, CloseProtocolError},
+		{"fragmented control frame", 0, []byte{opPing, 0}, CloseProtocolError},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		conn := newConn(client, nil, true)
+		conn.SetReadLimit(test.limit)
+		go func(data []byte) {
+			server.Write(data)
+			io.Copy(io.Discard, server)
+		}(test.data)
+
+		var ce *CloseError
+		if err := conn.ReadTo(io.Discard); !errors.As(err, &ce) || ce.Code != test.code {
+			t.Errorf("%s: expected close code %d, got %v", test.name, test.code, err)
+		}
+		client.Close()
+		server.Close()
+	}
+
+	//Messages at the limit are read
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := newConn(client, nil, true)
+	conn.SetReadLimit(5)
+	go server.Write([]byte{msbOn | opText, 5, 'h', 'e', 'l', 'l', 'o'})
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Errorf("Message at the limit not read: %q, %v", msg, err)
+	}
+}
+
+func TestWriteFrame(t *testing.T) {
+
+	//Header and payload arrive together, the payload is masked for clients only
+	for _, client := range []bool{false, true} {
+		local, remote := net.Pipe()
+		conn := newConn(local, nil, client)
+		msg := bytes.Repeat([]byte("payload "), 20)
+		go conn.WriteMessage(BinaryMessage, msg)
+
+		var f DataFrame
+		br := bufio.NewReader(remote)
+		if _, err := f.ReadFrom(br); err != nil {
+			t.Fatal(err)
+		}
+		if (f.masked == msbOn) != client || f.op != opBinary || f.length != len(msg) {
+			t.Errorf("Unexpected header for client %v: %+v", client, f)
+		}
+		got := make([]byte, f.length)
+		if client {
+			if err := f.Decode(br, got); err != nil {
+				t.Fatal(err)
+			}
+		} else if _, err := io.ReadFull(br, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("Payload for client %v was %q", client, got)
+		}
+		if !bytes.Equal(msg, bytes.Repeat([]byte("payload "), 20)) {
+			t.Errorf("Masking changed the caller's payload")
+		}
+
+		//Once warmed up, writing a message doesn't allocate
+		go io.Copy(io.Discard, remote)
+		allocs := testing.AllocsPerRun(100, func() {
+			conn.WriteMessage(BinaryMessage, msg)
+		})
+		if allocs > 0 {
+			t.Errorf("Writing a message allocated %v times for client %v", allocs, client)
+		}
+		local.Close()
+		remote.Close()
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+
+	exts, ok := parseExtensions([]string{`foo, permessage-deflate; client_max_window_bits; server_max_window_bits="15"`, ", bar;x=1"})
+	if !ok || len(exts) != 3 || exts[1].name != "permessage-deflate" || len(exts[1].params) != 2 ||
+		exts[1].params[1] != (ExtensionParam{"server_max_window_bits", "15"}) || exts[2].params[0] != (ExtensionParam{"x", "1"}) {
+		t.Errorf("Unexpected extensions %+v", exts)
+	}
+	for _, malformed := range []string{"permessage-deflate;", "a b", "a; x=", `a; x="unterminated`} {
+		if _, ok := parseExtensions([]string{malformed}); ok {
+			t.Errorf("Parsed malformed extensions %q", malformed)
+		}
+	}
+
+	//The first offer the server can honor is accepted
+	tests := []struct {
+		cfg      Compression
+		offer    string
+		response string
+	}{
+		{Compression{}, "permessage-deflate", "permessage-deflate"},
+		{Compression{}, "permessage-deflate; client_max_window_bits", "permessage-deflate"},
+		{Compression{}, "permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+			"permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+		{Compression{ServerNoContextTakeover: true}, "permessage-deflate", "permessage-deflate; server_no_context_takeover"},
+		{Compression{}, "permessage-deflate; server_max_window_bits=10, permessage-deflate; server_max_window_bits=15",
+			"permessage-deflate; server_max_window_bits=15"},
+		{Compression{}, "permessage-deflate; unknown, permessage-deflate; client_max_window_bits=16, x-webkit-deflate-frame", ""},
+		{Compression{}, "permessage-deflate; server_no_context_takeover; server_no_context_takeover", ""},
+		{Compression{}, "permessage-deflate; server_max_window_bits=09", ""},
+		{Compression{ClientMaxWindowBits: 10}, "permessage-deflate; client_max_window_bits", "permessage-deflate; client_max_window_bits=10"},
+		{Compression{ClientMaxWindowBits: 10}, "permessage-deflate; client_max_window_bits=9", "permessage-deflate"},
+		{Compression{ClientMaxWindowBits: 10}, "permessage-deflate", "permessage-deflate"},
+		{Compression{ClientMaxWindowBits: 16, ServerMaxWindowBits: 10}, "permessage-deflate; client_max_window_bits", "permessage-deflate"},
+	}
+	for _, test := range tests {
+		u := Upgrader{Compression: &test.cfg}
+		n := u.negotiate(&http.Request{Header: http.Header{"Sec-Websocket-Extensions": {test.offer}}})
+		if got := strings.Join(n.response, ", "); got != test.response {
+			t.Errorf("Offer %q: got response %q, expected %q", test.offer, got, test.response)
+		}
+	}
+
+	//Clients offer the window limits they can honor
+	if offer := (&Compression{ServerMaxWindowBits: 10, ClientMaxWindowBits: 9}).offer(); offer != "permessage-deflate; server_max_window_bits=10; client_max_window_bits" {
+		t.Errorf("Unexpected offer %q", offer)
+	}
+
+	//Clients refuse responses they did not ask for
+	cfg := &Compression{ServerNoContextTakeover: true, ServerMaxWindowBits: 10}
+	for _, response := range []string{"permessage-deflate", "permessage-deflate; server_no_context_takeover", "permessage-deflate; server_no_context_takeover; server_max_window_bits=12",
+		"permessage-deflate; server_max_window_bits=9; client_max_window_bits=16", "other", "permessage-deflate, permessage-deflate"} {
+		if _, reason := confirmExtensions(http.Header{"Sec-Websocket-Extensions": {response}}, cfg, nil); reason == "" {
+			t.Errorf("Client accepted response %q", response)
+		}
+	}
+	if _, reason := confirmExtensions(http.Header{"Sec-Websocket-Extensions": {"permessage-deflate"}}, nil, nil); reason == "" {
+		t.Errorf("Client accepted compression it did not offer")
+	}
+	n, reason := confirmExtensions(http.Header{"Sec-Websocket-Extensions": {"permessage-deflate; server_no_context_takeover; server_max_window_bits=9"}}, cfg, nil)
+	if reason != "" || !n.deflate.serverNoContextTakeover {
+		t.Fatalf("Client refused a valid response: %s", reason)
+	}
+	if d := newDeflateState(n.deflate, cfg, true); d.readWindow != 1<<9 || !d.compresses(100) {
+		t.Errorf("Unexpected windows %d and %d", d.readWindow, d.writeWindow)
+	}
+
+	//A limit on the client's window is honored by sending uncompressed
+	n, reason = confirmExtensions(http.Header{"Sec-Websocket-Extensions": {"permessage-deflate; client_max_window_bits=10"}}, &Compression{}, nil)
+	if reason != "" {
+		t.Fatalf("Client refused a valid response: %s", reason)
+	}
+	if d := newDeflateState(n.deflate, nil, true); d.writeWindow != 1<<10 || d.compresses(100) {
+		t.Errorf("Client compresses with a limited window")
+	}
+}
+
+func TestCompression(t *testing.T) {
+
+	server := NewServer(func(c *Conn, m []byte) {
+		c.Write(m)
+	})
+	server.Compression = &Compression{Threshold: 16}
+	hs := httptest.NewServer(server)
+	defer hs.Close()
+
+	//Each side compresses with and without keeping its context
+	for _, cfg := range []Compression{{}, {ServerNoContextTakeover: true, ClientNoContextTakeover: true}, {Level: flate.BestSpeed}} {
+		dialer := Dialer{Compression: &cfg}
+		conn, err := dialer.DialURL(context.Background(), "ws://"+hs.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Error dialing server: %s", err)
+		}
+		if conn.deflate == nil {
+			t.Fatalf("Compression was not negotiated for %+v", cfg)
+		}
+
+		for _, msg := range []string{"short", strings.Repeat(`{"chat": "hello, hello"}`, 500), "", strings.Repeat("more of the same, ", 5000)} {
+			for i := 0; i < 2; i++ {
+				if _, err = conn.WriteString(msg); err != nil {
+					t.Fatal(err)
+				}
+				if _, got, err := conn.ReadMessage(); err != nil || string(got) != msg {
+					t.Fatalf("Echo of a %d byte message failed with %+v: %v", len(msg), cfg, err)
+				}
+			}
+		}
+		conn.Base().Close()
+	}
+
+	//Without compression on the server, the client goes without
+	plain := httptest.NewServer(NewServer(nil))
+	defer plain.Close()
+	dialer := Dialer{Compression: &Compression{}}
+	conn, err := dialer.DialURL(context.Background(), "ws://"+plain.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	if conn.deflate != nil {
+		t.Errorf("Compression negotiated with a server that does not support it")
+	}
+	conn.Base().Close()
+}
+
+func TestCompressedFrames(t *testing.T) {
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	conn := newConn(local, nil, false)
+	conn.deflate, conn.rsv = newDeflateState(&deflateParams{}, &Compression{Threshold: 10}, false), rsv1
+	br := bufio.NewReader(remote)
+
+	//Only the first frame of messages over the threshold is flagged, and the payload is smaller
+	msg := bytes.Repeat([]byte("compress me "), 100)
+	readFrame := func() DataFrame {
+		var f DataFrame
+		if _, err := f.ReadFrom(br); err != nil {
+			t.Fatal(err)
+		}
+		io.CopyN(io.Discard, br, int64(f.length))
+		return f
+	}
+	for _, test := range []struct {
+		msg        []byte
+		enabled    bool
+		compressed bool
+	}{{msg, true, true}, {msg[:9], true, false}, {msg, false, false}} {
+		conn.EnableWriteCompression(test.enabled)
+		go conn.WriteMessage(BinaryMessage, test.msg)
+		f := readFrame()
+		if (f.rsv == rsv1) != test.compressed || test.compressed && f.length >= len(test.msg) {
+			t.Errorf("Unexpected frame for a %d byte message: %+v", len(test.msg), f)
+		}
+	}
+	conn.EnableWriteCompression(true)
+	conn.SetFragmentSize(8)
+	go conn.WriteMessage(BinaryMessage, msg)
+	if f := readFrame(); f.rsv != rsv1 || f.fin != 0 {
+		t.Errorf("Unexpected first fragment %+v", f)
+	}
+	for f := readFrame(); ; f = readFrame() {
+		if f.rsv != 0 {
+			t.Errorf("RSV1 set on a continuation frame")
+		}
+		if f.fin == msbOn {
+			break
+		}
+	}
+	if err := conn.SetCompressionLevel(42); err == nil {
+		t.Errorf("Accepted an invalid compression level")
+	}
+
+	//Invalid compressed data, or RSV1 without compression, fail the connection
+	for _, test := range []struct {
+		data    []byte
+		deflate bool
+		code    int
+	}{
+		{[]byte{msbOn | rsv1 | opText, 2, 0xff, 0xff}, true, CloseInvalidPayload},
+		{[]byte{msbOn | rsv1 | opText, 1, 0}, false, CloseProtocolError},
+		{[]byte{rsv1 | opText, 0, msbOn | rsv1 | opContinue, 0}, true, CloseProtocolError},
+		{[]byte{msbOn | 0x20 | opBinary, 0}, true, CloseProtocolError},
+		{[]byte{msbOn | rsv1 | opPing, 0}, true, CloseProtocolError},
+	} {
+		client, server := net.Pipe()
+		c := newConn(client, nil, true)
+		if test.deflate {
+			c.deflate, c.rsv = newDeflateState(&deflateParams{}, nil, true), rsv1
+		}
+		go func(data []byte) {
+			server.Write(data)
+			io.Copy(io.Discard, server)
+		}(test.data)
+
+		var ce *CloseError
+		if err := c.ReadTo(io.Discard); !errors.As(err, &ce) || ce.Code != test.code {
+			t.Errorf("Frames %v: expected close code %d, got %v", test.data, test.code, err)
+		}
+		client.Close()
+		server.Close()
+	}
+
+	//A message that decompresses to more than the read limit is refused
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	sender := newConn(server, nil, false)
+	sender.deflate = newDeflateState(&deflateParams{}, nil, false)
+	receiver := newConn(client, nil, true)
+	receiver.deflate, receiver.rsv = newDeflateState(&deflateParams{}, nil, true), rsv1
+	receiver.SetReadLimit(1000)
+	go func() {
+		sender.WriteMessage(BinaryMessage, make([]byte, 10000))
+		io.Copy(io.Discard, server)
+	}()
+	var ce *CloseError
+	if err := receiver.ReadTo(io.Discard); !errors.As(err, &ce) || ce.Code != CloseMessageTooBig {
+		t.Errorf("Expected close code 1009, got %v", err)
+	}
+}
+
+/*
+An extension flipping every payload bit, marking the frames it flipped with its RSV bit.
+*/
+type xorExtension struct {
+	rsv byte
+}
+
+func (x xorExtension) Name() string  { return "x-xor" }
+func (x xorExtension) Offer() string { return "mask=255" }
+func (x xorExtension) RSV() byte     { return x.rsv }
+
+func (x xorExtension) Accept(params []ExtensionParam) (string, ConnExtension, bool) {
+	if len(params) != 1 || params[0] != (ExtensionParam{"mask", "255"}) {
+		return "", nil, false
+	}
+	return "mask=255", x, true
+}
+
+func (x xorExtension) Confirm(params []ExtensionParam) (ConnExtension, error) {
+	if len(params) != 1 || params[0] != (ExtensionParam{"mask", "255"}) {
+		return nil, errors.New("unexpected x-xor parameters")
+	}
+	return x, nil
+}
+
+func (x xorExtension) WriteFrame(f *Frame) error {
+	payload := make([]byte, len(f.Payload))
+	for i, b := range f.Payload {
+		payload[i] = ^b
+	}
+	f.Payload = payload
+	f.RSV |= x.rsv
+	return nil
+}
+
+func (x xorExtension) ReadFrame(f *Frame) error {
+	if f.RSV&x.rsv == 0 {
+		return &CloseError{CloseUnsupportedData, "frame was not flipped"}
+	}
+	for i := range f.Payload {
+		f.Payload[i] = ^f.Payload[i]
+	}
+	f.RSV &^= x.rsv
+	return nil
+}
+
+func TestExtensions(t *testing.T) {
+
+	server := NewServer(func(c *Conn, m []byte) {
+		c.Write(m)
+	})
+	server.Compression = &Compression{}
+	server.Extensions = []Extension{xorExtension{RSV2}}
+	hs := httptest.NewServer(server)
+	defer hs.Close()
+
+	//Extensions work alongside compression, across fragments
+	dialer := Dialer{Compression: &Compression{}, Extensions: []Extension{xorExtension{RSV2}}}
+	conn, err := dialer.DialURL(context.Background(), "ws://"+hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	defer conn.Base().Close()
+	if conn.deflate == nil || len(conn.extensions) != 1 || conn.rsv != RSV1|RSV2 {
+		t.Fatalf("Extensions were not negotiated: %+v", conn.extensions)
+	}
+	conn.SetFragmentSize(10)
+	for _, msg := range []string{"flip me", strings.Repeat("flip and compress me ", 100)} {
+		if _, err = conn.WriteString(msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, got, err := conn.ReadMessage(); err != nil || string(got) != msg {
+			t.Errorf("Echo of %d bytes failed: %v", len(msg), err)
+		}
+	}
+
+	//Extensions can't share RSV bits, the first offer to claim one gets it
+	u := Upgrader{Compression: &Compression{}, Extensions: []Extension{xorExtension{RSV1}}}
+	req := &http.Request{Header: http.Header{"Sec-Websocket-Extensions": {"x-xor; mask=1, x-xor; mask=255, permessage-deflate"}}}
+	if n := u.negotiate(req); strings.Join(n.response, ", ") != "x-xor; mask=255" || n.deflate != nil {
+		t.Errorf("Unexpected negotiation %+v", n)
+	}
+	if _, reason := confirmExtensions(http.Header{"Sec-Websocket-Extensions": {"x-xor; mask=255, permessage-deflate"}},
+		&Compression{}, []Extension{xorExtension{RSV1}}); reason == "" {
+		t.Errorf("Client accepted extensions sharing an RSV bit")
+	}
+	if _, reason := confirmExtensions(http.Header{"Sec-Websocket-Extensions": {"x-xor; mask=2"}}, nil, []Extension{xorExtension{RSV2}}); reason == "" {
+		t.Errorf("Client accepted parameters its extension refused")
+	}
+
+	//Bits no extension uses fail the connection, and so do errors from extensions
+	for _, test := range []struct {
+		data []byte
+		code int
+	}{
+		{[]byte{msbOn | RSV3 | opBinary, 0}, CloseProtocolError},
+		{[]byte{msbOn | opBinary, 0}, CloseUnsupportedData},
+		{[]byte{msbOn | RSV2 | opBinary, 127, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, CloseMessageTooBig},
+		{[]byte{msbOn | RSV2 | opBinary, 127, 0, 0, 0, 2, 0, 0, 0, 0}, CloseMessageTooBig},
+	} {
+		client, server := net.Pipe()
+		c := newConn(client, nil, true)
+		c.extensions, c.rsv = []ConnExtension{xorExtension{RSV2}}, RSV2
+		go func(data []byte) {
+			server.Write(data)
+			io.Copy(io.Discard, server)
+		}(test.data)
+
+		var ce *CloseError
+		if err := c.ReadTo(io.Discard); !errors.As(err, &ce) || ce.Code != test.code {
+			t.Errorf("Frames %v: expected close code %d, got %v", test.data, test.code, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestStreaming(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	writer := newConn(client, nil, true)
+	reader := newConn(server, nil, false)
+	writer.SetFragmentSize(16)
+
+	//Fragments go out as the message is written, before it is closed
+	w, err := writer.NextWriter(BinaryMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := bytes.Repeat([]byte("0123456789"), 10)
+	written := make(chan error, 1)
+	go func() {
+		for i := 0; i < len(msg); i += 7 {
+			if _, err := w.Write(msg[i:min(i+7, len(msg))]); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- w.Close()
+	}()
+	msgType, r, err := reader.NextReader()
+	if err != nil || msgType != BinaryMessage {
+		t.Fatalf("Unexpected message %d: %v", msgType, err)
+	}
+	got := make([]byte, 16)
+	if _, err = io.ReadFull(r, got); err != nil || !bytes.Equal(got, msg[:16]) {
+		t.Fatalf("First fragment not readable before the message was closed: %q %v", got, err)
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(rest, msg[16:]) {
+		t.Errorf("Unexpected rest of message %q: %v", rest, err)
+	}
+	if err = <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	//Unread parts of a message are skipped
+	go func() {
+		writer.WriteMessage(TextMessage, []byte("skipped in part"))
+		writer.WriteMessage(TextMessage, []byte("next"))
+	}()
+	if _, r, err = reader.NextReader(); err != nil {
+		t.Fatal(err)
+	}
+	io.ReadFull(r, make([]byte, 3))
+	if _, r, err = reader.NextReader(); err != nil {
+		t.Fatal(err)
+	}
+	if next, err := io.ReadAll(r); err != nil || string(next) != "next" {
+		t.Errorf("Expected the next message, got %q: %v", next, err)
+	}
+
+	//Invalid text is refused as it is written
+	w, _ = writer.NextWriter(TextMessage)
+	if _, err = w.Write([]byte("ok \xff")); err != ErrInvalidUTF8 {
+		t.Errorf("Wrote invalid text: %v", err)
+	}
+	if err = w.Close(); err != ErrInvalidUTF8 {
+		t.Errorf("Closed a message with invalid text: %v", err)
+	}
+	if _, err = w.Write([]byte("more")); err == nil {
+		t.Errorf("Wrote to a closed message writer")
+	}
+	if _, err = writer.NextWriter(opPing); err == nil {
+		t.Errorf("Started a message with a control opcode")
+	}
+
+	//Compressed messages stream both ways
+	upgrader := Upgrader{Compression: &Compression{Threshold: 64}}
+	hs := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		c, err := upgrader.Upgrade(rw, req)
+		if err != nil {
+			return
+		}
+		for {
+			msgType, r, err := c.NextReader()
+			if err != nil {
+				return
+			}
+			w, _ := c.NextWriter(msgType)
+			io.Copy(w, r)
+			w.Close()
+		}
+	}))
+	defer hs.Close()
+	dialer := Dialer{Compression: &Compression{}}
+	conn, err := dialer.DialURL(context.Background(), "ws://"+hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	defer conn.Base().Close()
+	conn.SetFragmentSize(1000)
+	for _, msg := range [][]byte{[]byte("small"), bytes.Repeat([]byte("stream me "), 10000), make([]byte, 3000)} {
+		w, _ := conn.NextWriter(BinaryMessage)
+		go func() {
+			w.Write(msg)
+			w.Close()
+		}()
+		_, r, err := conn.NextReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("Streamed echo of %d bytes failed: %v", len(msg), err)
+		}
+	}
+}
+
+func TestNetConn(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	remote := newConn(client, nil, true)
+	nc := NetConn(newConn(server, nil, false), BinaryMessage)
+
+	if nc.LocalAddr() != server.LocalAddr() || nc.RemoteAddr() != server.RemoteAddr() {
+		t.Errorf("Addresses differ from the base connection")
+	}
+
+	//Reads span messages, empty ones included
+	go func() {
+		remote.WriteMessage(BinaryMessage, []byte("hello, "))
+		remote.WriteMessage(BinaryMessage, nil)
+		remote.WriteMessage(TextMessage, []byte("world"))
+	}()
+	got := make([]byte, 12)
+	if _, err := io.ReadFull(nc, got); err != nil || string(got) != "hello, world" {
+		t.Errorf("Unexpected stream %q: %v", got, err)
+	}
+
+	//Writes are binary messages
+	go nc.Write([]byte("tunneled"))
+	msgType, msg, err := remote.ReadMessage()
+	if err != nil || msgType != BinaryMessage || string(msg) != "tunneled" {
+		t.Errorf("Unexpected message %d %q: %v", msgType, msg, err)
+	}
+
+	//A deadline passing between messages leaves the connection readable
+	nc.SetDeadline(time.Now().Add(10 * time.Millisecond))
+	var ne net.Error
+	if _, err = nc.Read(got); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	nc.SetDeadline(time.Time{})
+	go remote.WriteMessage(BinaryMessage, []byte("again"))
+	if n, err := nc.Read(got); err != nil || string(got[:n]) != "again" {
+		t.Errorf("Unexpected read after a timeout %q: %v", got[:n], err)
+	}
+
+	//So does one passing partway through a message, between fragments or in a payload
+	go client.Write([]byte{opBinary, msbOn | 3, 0, 0, 0, 0, 'h', 'e', 'l'})
+	if _, err = io.ReadFull(nc, got[:3]); err != nil || string(got[:3]) != "hel" {
+		t.Fatalf("Unexpected first fragment %q: %v", got[:3], err)
+	}
+	for _, part := range [][]byte{{msbOn | opContinue, msbOn | 2, 0, 0, 0, 0, 'l'}, {'o'}} {
+		nc.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, err = nc.Read(got); !errors.As(err, &ne) || !ne.Timeout() {
+			t.Fatalf("Expected a timeout, got %v", err)
+		}
+		nc.SetReadDeadline(time.Time{})
+		go client.Write(part)
+		if n, err := nc.Read(got); err != nil || n != 1 || got[0] != part[len(part)-1] {
+			t.Fatalf("Unexpected read after a timeout in a message %q: %v", got[:n], err)
+		}
+	}
+
+	//A normal close ends the stream
+	go remote.CloseWithCode(CloseNormal, "")
+	if _, err = nc.Read(got); err != io.EOF {
+		t.Errorf("Expected EOF after close, got %v", err)
+	}
+}
+
+func BenchmarkMessage100B(b *testing.B)  { benchmarkMessage(b, 100) }
+func BenchmarkMessage64KiB(b *testing.B) { benchmarkMessage(b, 64*1024) }
+func BenchmarkMessage16MiB(b *testing.B) { benchmarkMessage(b, 16*1024*1024) }
+
+/*
+Sends messages of the given size from a client to a server, which masks and unmasks every payload.
+*/
+func benchmarkMessage(b *testing.B, size int) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	clientConn := newConn(client, nil, true)
+	serverConn := newConn(server, nil, false)
+
+	read := make(chan error, 1)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if err := serverConn.ReadTo(io.Discard); err != nil {
+				read <- err
+				return
+			}
+		}
+		read <- nil
+	}()
+
+	msg := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := clientConn.WriteMessage(BinaryMessage, msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := <-read; err != nil {
+		b.Fatal(err)
+	}
+}
@@ -0,0 +1,129 @@
+package ws
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+An Upgrader upgrades HTTP requests to WebSocket connections.
+It can be used from any http.Handler, so WebSockets can share a port with regular handlers.
+*/
+type Upgrader struct {
+	//Subprotocols the server supports. The first protocol offered by a client that is also in this list is chosen.
+	Subprotocols []string
+
+	//SelectSubprotocol, if set, chooses the subprotocol instead of Subprotocols.
+	//It is given the protocols offered by the client in order of preference and must return one of them, or an empty string for none.
+	SelectSubprotocol func(req *http.Request, offered []string) string
+
+	//CheckOrigin returns true if a request with the given Origin header may connect, otherwise it is answered with 403 Forbidden.
+	//If nil, SameOrigin is used. See AllowOrigins for accepting other origins.
+	CheckOrigin func(req *http.Request) bool
+
+	//Compression, if set, accepts clients offering to compress messages with permessage-deflate.
+	Compression *Compression
+
+	//Extensions the server supports. Each is accepted with the first of the client's offers for it that the extension accepts.
+	Extensions []Extension
+}
+
+/*
+Upgrade validates the opening handshake in req, hijacks the underlying connection and replies with an accept response.
+If the request is rejected, an HTTP error response is written to w and a RequestError is returned.
+The returned connection is not registered with any Server.
+*/
+func (u *Upgrader) Upgrade(w http.ResponseWriter, req *http.Request) (*Conn, error) {
+	protocol, re := u.check(req)
+	if re != nil {
+		h := w.Header()
+		for k, v := range re.response().Header {
+			h[k] = v
+		}
+		w.WriteHeader(re.StatusCode)
+		w.Write([]byte(re.Reason + "\n"))
+		return nil, re
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket upgrade not supported", http.StatusInternalServerError)
+		return nil, errors.New("ResponseWriter does not implement http.Hijacker.")
+	}
+	c, rw, e := hj.Hijack()
+	if e != nil {
+		return nil, e
+	}
+
+	//Clear any deadlines set by the http.Server
+	c.SetDeadline(time.Time{})
+
+	//Data may already be buffered for the connection, so keep reading through the same reader
+	var br *bufio.Reader
+	if rw != nil {
+		br = rw.Reader
+	}
+
+	extensions := u.negotiate(req)
+	if e = createAcceptResponse(req, protocol, extensions.response).Write(c); e != nil {
+		c.Close()
+		return nil, e
+	}
+
+	wsc := newConn(c, br, false)
+	wsc.subprotocol = protocol
+	extensions.apply(wsc, u.Compression, false)
+	return wsc, nil
+}
+
+/*
+Checks that req is a valid opening handshake from an allowed origin.
+Returns the chosen subprotocol, or the RequestError to reply with if it is rejected.
+*/
+func (u *Upgrader) check(req *http.Request) (string, *RequestError) {
+	if re := checkRequest(req); re != nil {
+		return "", re
+	}
+
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = SameOrigin
+	}
+	if !checkOrigin(req) {
+		return "", &RequestError{http.StatusForbidden, nil, "origin not allowed"}
+	}
+
+	return u.selectSubprotocol(req), nil
+}
+
+/*
+Chooses the subprotocol for req, returning an empty string if there is none in common.
+*/
+func (u *Upgrader) selectSubprotocol(req *http.Request) string {
+	offered := splitTokens(strings.Join(req.Header.Values("Sec-WebSocket-Protocol"), ","))
+	if len(offered) == 0 {
+		return ""
+	}
+
+	if u.SelectSubprotocol != nil {
+		protocol := u.SelectSubprotocol(req, offered)
+		for _, p := range offered {
+			if p == protocol {
+				return protocol
+			}
+		}
+		return ""
+	}
+
+	for _, p := range offered {
+		for _, supported := range u.Subprotocols {
+			if p == supported {
+				return p
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,65 @@
+package ws
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+/*
+ErrInvalidUTF8 is returned when a text message is not valid UTF-8.
+*/
+var ErrInvalidUTF8 = errors.New("Text message is not valid UTF-8.")
+
+/*
+Validates UTF-8 text written to it in pieces, which may split a character between them.
+*/
+type utf8Validator struct {
+	pending [utf8.UTFMax]byte
+	n       int
+}
+
+/*
+Validates the next piece of text, keeping an incomplete character at its end for the next piece.
+*/
+func (v *utf8Validator) Write(p []byte) (int, error) {
+	written := len(p)
+
+	//Complete the character left over from the last piece
+	for v.n > 0 && len(p) > 0 {
+		v.pending[v.n] = p[0]
+		v.n++
+		p = p[1:]
+		if utf8.FullRune(v.pending[:v.n]) {
+			if r, size := utf8.DecodeRune(v.pending[:v.n]); r == utf8.RuneError && size == 1 {
+				return 0, ErrInvalidUTF8
+			}
+			v.n = 0
+		}
+	}
+
+	//Hold back an incomplete character at the end
+	end := len(p)
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	if !utf8.Valid(p[:end]) {
+		return 0, ErrInvalidUTF8
+	}
+	v.n += copy(v.pending[v.n:], p[end:])
+	return written, nil
+}
+
+/*
+Returns an error if the text ended in the middle of a character.
+*/
+func (v *utf8Validator) Close() error {
+	if v.n > 0 {
+		return ErrInvalidUTF8
+	}
+	return nil
+}